@@ -0,0 +1,359 @@
+package raft
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// maxApplyPending limits entries waiting to apply, proposals
+// are throttled until application catches up.
+const maxApplyPending = 4096
+
+// BatchApplication could be implemented by Application
+// to apply committed entries in batch.
+type BatchApplication interface {
+	// ApplyEntries apply entries in order, it is called instead of ApplyEntry.
+	ApplyEntries(entries []raftpd.Entry)
+}
+
+// applyTask is a batch of committed entries.
+type applyTask struct {
+	entries []raftpd.Entry
+	// fail proposals before term after entries applied, if non zero.
+	lostTerm uint64
+}
+
+// applier applies committed entries on its own goroutine, so that
+// slow application would not stall raft loop.
+type applier struct {
+	raft   *Raft
+	policy SnapshotPolicy
+
+	mutex    sync.Mutex
+	cond     *sync.Cond /* tasks added, applied or stopped */
+	tasks    []applyTask
+	pending  int /* entries queued or applying */
+	applied  uint64
+	stopped  bool
+	leaving  bool  /* raft is stopped by callback, stop mustn't wait applier */
+	goid     int64 /* goroutine runs applier, to detect calls by callbacks */
+	appliedc chan struct{}
+	donec    chan struct{}
+
+	// snapshot fields.
+	appliedTerm   uint64
+	sinceEntries  uint64    /* entries applied since last snapshot */
+	sinceBytes    uint64    /* bytes of entries applied since last snapshot */
+	lastSnapshot  time.Time /* time of last snapshot */
+	lastSnapIndex uint64    /* index of last snapshot taken or restored */
+	snapshotIndex uint64    /* snapshot taken but log isn't compacted */
+	requested     bool      /* snapshot is requested by leader for follower */
+}
+
+func makeApplier(raft *Raft) *applier {
+	a := &applier{
+		raft:     raft,
+		appliedc: make(chan struct{}, 1),
+		donec:    make(chan struct{}),
+	}
+	a.cond = sync.NewCond(&a.mutex)
+	return a
+}
+
+// push queue task without blocking.
+func (a *applier) push(task applyTask) {
+	if len(task.entries) == 0 && task.lostTerm == 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.tasks = append(a.tasks, task)
+	a.pending += len(task.entries)
+	a.cond.Broadcast()
+}
+
+// throttle wait until entries pending is under limit. Callbacks
+// aren't throttled, pending entries couldn't decrease until they return.
+func (a *applier) throttle() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for a.pending >= maxApplyPending && !a.stopped {
+		if a.goid != 0 && a.goid == goroutineID() {
+			return
+		}
+		a.cond.Wait()
+	}
+}
+
+// onApplier test whether it is called by callbacks on applier goroutine.
+func (a *applier) onApplier() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.goid != 0 && a.goid == goroutineID()
+}
+
+// leave tell stop not to wait applier, because raft is stopped by
+// callback on applier, applier exits after callback returns.
+func (a *applier) leave() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.leaving = true
+}
+
+// isStopped test whether applier has been stopped.
+func (a *applier) isStopped() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.stopped
+}
+
+// flush wait until all tasks queued are applied.
+func (a *applier) flush() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for a.pending > 0 && !a.stopped {
+		a.cond.Wait()
+	}
+}
+
+// appliedIndex return index of last entry applied.
+func (a *applier) appliedIndex() uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.applied
+}
+
+// appliedTo advance applied index by snapshot restored.
+func (a *applier) appliedTo(metadata *raftpd.SnapshotMetadata) {
+	a.mutex.Lock()
+	if a.applied < metadata.Index {
+		a.applied = metadata.Index
+		a.appliedTerm = metadata.Term
+	}
+	a.mutex.Unlock()
+
+	a.snapshotTaken(metadata.Index)
+	a.raft.reads.appliedTo(metadata.Index)
+}
+
+// requestSnapshot ask to take snapshot regardless of policy.
+func (a *applier) requestSnapshot() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.requested = true
+	a.cond.Broadcast()
+}
+
+// snapshotTaken restart counting for snapshot policy,
+// after snapshot at index taken or restored.
+func (a *applier) snapshotTaken(index uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.requested = false
+	a.sinceEntries = 0
+	a.sinceBytes = 0
+	a.lastSnapshot = time.Now()
+	if a.lastSnapIndex < index {
+		a.lastSnapIndex = index
+	}
+}
+
+// takeSnapshotIndex return index of snapshot taken by policy,
+// and zero if there is none since last call.
+func (a *applier) takeSnapshotIndex() uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	index := a.snapshotIndex
+	a.snapshotIndex = 0
+	return index
+}
+
+// stop discard tasks queued, and wait task applying finished,
+// unless raft is stopped by callback applying task.
+func (a *applier) stop() {
+	a.mutex.Lock()
+	a.stopped = true
+	a.tasks = nil
+	a.cond.Broadcast()
+	leaving := a.leaving
+	a.mutex.Unlock()
+
+	if !leaving {
+		<-a.donec
+	}
+}
+
+func (a *applier) run() {
+	defer close(a.donec)
+
+	a.mutex.Lock()
+	a.goid = goroutineID()
+	a.mutex.Unlock()
+
+	for {
+		a.mutex.Lock()
+		for len(a.tasks) == 0 && !a.stopped && !a.requested {
+			a.cond.Wait()
+		}
+		if a.stopped {
+			a.mutex.Unlock()
+			return
+		}
+		tasks := a.tasks
+		a.tasks = nil
+		a.mutex.Unlock()
+
+		for i := 0; i < len(tasks); i++ {
+			if a.isStopped() {
+				/* stopped by callback */
+				return
+			}
+			a.apply(&tasks[i])
+			a.advance(tasks[i].entries)
+			// take snapshot before task is done, so that flush
+			// returns after state machine is stable.
+			a.maybeSnapshot()
+
+			a.mutex.Lock()
+			a.pending -= len(tasks[i].entries)
+			a.cond.Broadcast()
+			a.mutex.Unlock()
+		}
+		if len(tasks) == 0 {
+			/* requested without entries to apply */
+			a.maybeSnapshot()
+		}
+
+		// tell raft loop applied index has changed.
+		select {
+		case a.appliedc <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advance record entries applied.
+func (a *applier) advance(entries []raftpd.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	last := entries[len(entries)-1]
+	a.applied = last.Index
+	a.appliedTerm = last.Term
+	a.sinceEntries += uint64(len(entries))
+	for i := 0; i < len(entries); i++ {
+		a.sinceBytes += uint64(len(entries[i].Data))
+	}
+}
+
+// maybeSnapshot ask application to take snapshot if policy is due
+// or snapshot is requested, log will be compacted by raft loop if
+// policy is enabled. Request is dropped if application doesn't take
+// snapshot, or nothing is applied since last snapshot.
+func (a *applier) maybeSnapshot() {
+	a.mutex.Lock()
+	due := a.requested || a.policy.due(a.sinceEntries, a.sinceBytes, a.lastSnapshot)
+	a.requested = false
+	metadata := raftpd.SnapshotMetadata{
+		Index: a.applied,
+		Term:  a.appliedTerm,
+	}
+	last := a.lastSnapIndex
+	stopped := a.stopped
+	a.mutex.Unlock()
+	app, ok := a.raft.callback.(SnapshotApplication)
+	if stopped || !due || !ok || metadata.Index == 0 || metadata.Index <= last {
+		return
+	}
+
+	metadata.ConfState = a.raft.membership.at(metadata.Index)
+	if err := app.SaveSnapshot(&metadata); err != nil {
+		log.Warnf("%d take snapshot [index: %d, term: %d] failed: %v",
+			a.raft.id, metadata.Index, metadata.Term, err)
+		return
+	}
+
+	log.Debugf("%d take snapshot [index: %d, term: %d]",
+		a.raft.id, metadata.Index, metadata.Term)
+
+	a.snapshotTaken(metadata.Index)
+	if !a.policy.enabled() {
+		/* log is compacted by application by Raft.Compact */
+		return
+	}
+	a.mutex.Lock()
+	a.snapshotIndex = metadata.Index
+	a.mutex.Unlock()
+}
+
+func (a *applier) apply(task *applyTask) {
+	raft := a.raft
+	entries := task.entries
+
+	normal := make([]raftpd.Entry, 0, len(entries))
+	for i := 0; i < len(entries); i++ {
+		if entries[i].Type == raftpd.EntryNormal {
+			normal = append(normal, entries[i])
+		}
+	}
+	if batch, ok := raft.callback.(BatchApplication); ok {
+		if len(normal) > 0 {
+			batch.ApplyEntries(normal)
+		}
+	} else {
+		for i := 0; i < len(normal) && !a.isStopped(); i++ {
+			raft.callback.ApplyEntry(&normal[i])
+		}
+	}
+	if a.isStopped() {
+		/* stopped by callback, entries might not be applied */
+		return
+	}
+
+	for i := 0; i < len(entries); i++ {
+		raft.proposals.applied(&entries[i])
+	}
+	if len(entries) > 0 {
+		raft.reads.appliedTo(entries[len(entries)-1].Index)
+	}
+	if task.lostTerm != 0 {
+		raft.proposals.failBefore(task.lostTerm, ErrLeadershipLost)
+	}
+}
+
+// goroutineID return id of current goroutine, or zero if unknown.
+func goroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	// stack trace begins with "goroutine 18 [running]:".
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
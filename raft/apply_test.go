@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+type batchApplication struct {
+	nopApplication
+	mutex   sync.Mutex
+	batches [][]raftpd.Entry
+	block   chan struct{}
+}
+
+func (app *batchApplication) ApplyEntries(entries []raftpd.Entry) {
+	if app.block != nil {
+		<-app.block
+	}
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.batches = append(app.batches, entries)
+}
+
+func makeApplyEntries(from, to uint64) []raftpd.Entry {
+	entries := []raftpd.Entry{}
+	for i := from; i <= to; i++ {
+		entries = append(entries, raftpd.Entry{Index: i, Term: 1, Type: raftpd.EntryNormal})
+	}
+	return entries
+}
+
+func TestApplier_Batch(t *testing.T) {
+	app := &batchApplication{}
+	raft := makeRaft(1)
+	raft.callback = app
+	go raft.applier.run()
+	defer raft.applier.stop()
+
+	entries := makeApplyEntries(1, 3)
+	entries[1].Type = raftpd.EntryConfChange
+	raft.applier.push(applyTask{entries: entries})
+	raft.applier.flush()
+
+	select {
+	case <-raft.applier.appliedc:
+	case <-time.After(time.Second):
+		t.Fatalf("applied index should be noticed")
+	}
+	if index := raft.applier.appliedIndex(); index != 3 {
+		t.Fatalf("applied index want: %d, get: %d", 3, index)
+	}
+
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if len(app.batches) != 1 || len(app.batches[0]) != 2 ||
+		app.batches[0][0].Index != 1 || app.batches[0][1].Index != 3 {
+		t.Fatalf("want normal entries [1, 3] in one batch, get: %v", app.batches)
+	}
+}
+
+func TestApplier_Throttle(t *testing.T) {
+	app := &batchApplication{block: make(chan struct{})}
+	raft := makeRaft(1)
+	raft.callback = app
+	go raft.applier.run()
+
+	raft.applier.push(applyTask{entries: makeApplyEntries(1, maxApplyPending)})
+
+	throttled := make(chan struct{})
+	go func() {
+		raft.applier.throttle()
+		close(throttled)
+	}()
+
+	select {
+	case <-throttled:
+		t.Fatalf("proposal should be throttled when apply queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(app.block)
+	select {
+	case <-throttled:
+	case <-time.After(time.Second):
+		t.Fatalf("proposal should continue after entries applied")
+	}
+	raft.applier.stop()
+}
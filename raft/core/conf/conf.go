@@ -14,6 +14,23 @@ const (
 	InvalidTerm  uint64 = 0
 )
 
+// ReadOnlyOption specifies how the read only request is processed.
+type ReadOnlyOption int
+
+// Read only options.
+const (
+	// ReadOnlySafe confirms leadership by a round of heartbeats to a
+	// quorum for read only requests. It is the default option.
+	ReadOnlySafe ReadOnlyOption = iota
+
+	// ReadOnlyLeaseBased answers read only requests without heartbeats while
+	// leader holds a lease. Once a quorum responds heartbeats of a request,
+	// lease lasts a bit less than election timeout since they were sent.
+	// Lease relies on clocks of nodes running at nearly the same rate, reads
+	// might be stale if a clock pauses or drifts beyond the margin of lease.
+	ReadOnlyLeaseBased
+)
+
 // Config given information to build raft algorithm.
 type Config struct {
 	// Id is the identity of the local raft. id cannot be 0.
@@ -37,8 +54,20 @@ type Config struct {
 
 	MaxSizePreMsg uint
 
-	Nodes   []uint64
-	Entries []raftpd.Entry
+	// ReadOnlyOption specifies how the read only request is processed. Under
+	// ReadOnlyLeaseBased, leader answers read only request with commit index
+	// directly if it is in lease, otherwise falls back to ReadOnlySafe.
+	ReadOnlyOption ReadOnlyOption
+
+	// Nodes contains the IDs of all voters in the raft group, and Learners
+	// contains the IDs of all learners, which receive entries from leader
+	// but do not vote and are not counted in quorum. OutgoingNodes contains
+	// the IDs of voters in old configuration if raft group is in joint
+	// consensus.
+	Nodes         []uint64
+	Learners      []uint64
+	OutgoingNodes []uint64
+	Entries       []raftpd.Entry
 }
 
 // Verify check whether fields of Config is valid.
@@ -55,5 +84,9 @@ func (c *Config) Verify() bool {
 		log.Panicf("election tick must be great than zero")
 	}
 
+	if c.ReadOnlyOption != ReadOnlySafe && c.ReadOnlyOption != ReadOnlyLeaseBased {
+		log.Panicf("unknown read only option: %d", c.ReadOnlyOption)
+	}
+
 	return true
 }
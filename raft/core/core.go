@@ -1,6 +1,8 @@
 package core
 
 import (
+	"io"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/core/holder"
@@ -8,7 +10,6 @@ import (
 	"github.com/thinkermao/bior/raft/core/read"
 	"github.com/thinkermao/bior/raft/proto"
 	"github.com/thinkermao/bior/utils"
-	"github.com/thinkermao/bior/utils/pd"
 )
 
 type application interface {
@@ -21,14 +22,22 @@ type application interface {
 	// applyEntry apply entry to state machine.
 	applyEntry(entry *raftpd.Entry)
 
-	// applySnapshot apply snapshot to state machine.
+	// openSnapshot return metadata and data reader of latest snapshot
+	// has been persisted by state machine, reader is nil if snapshot
+	// is building at now.
+	openSnapshot() (raftpd.SnapshotMetadata, io.ReadCloser)
+
+	// requestSnapshot ask to build snapshot for node, because
+	// entries it needs have been compacted.
+	requestSnapshot(nodeID uint64)
+
+	// createSnapshot return writer of snapshot receiving from leader.
+	createSnapshot(metadata *raftpd.SnapshotMetadata) (io.WriteCloser, error)
+
+	// restoreSnapshot apply snapshot received to state machine.
 	// When snapshot has been persisted by state machine,
 	// should call ApplySnapshot to rebuild log infos.
-	applySnapshot(snapshot *raftpd.Snapshot)
-
-	// readSnapshot return latest snapshot has been persisted
-	// from state machine.
-	readSnapshot() *raftpd.Snapshot
+	restoreSnapshot(metadata *raftpd.SnapshotMetadata)
 }
 
 type core struct {
@@ -38,28 +47,42 @@ type core struct {
 	log  *holder.LogHolder // log holder
 
 	// Fields just keep in memory.
-	id uint64 // raft id
+	id        uint64 // raft id
+	isLearner bool   // whether self is learner
 
 	// last leader id. If the long time did not
 	// receive the leader's message, set InvalidID.
 	leaderID uint64
 	state    StateRole    // current state role
 	nodes    []*peer.Node // information of other nodes in same raft group.
+	voters   []uint64     // voters of current configuration.
+	outgoing []uint64     // voters of old configuration in joint consensus.
 
 	// Fields for time.
 	timeElapsed            int // total elapsed
 	randomizedElectionTick int // randomized election tick
 	electionTick           int // basis election tick
 	heartbeatTick          int // heartbeat timeout tick
+	clock                  int // time elapsed since start, never reset
+	leaseExpire            int // leader is in lease before clock reaches it
 
 	// member-ship change fields.
 	pendingConf bool // new configuration is ignored if
 	// there exists unapplied configuration.
 
+	// leader transfer fields.
+	leadTransferee  uint64 // id of transfer target, InvalidID if no transfer.
+	transferElapsed int    // time elapsed since leader transfer began.
+
+	// snapshot transfer fields.
+	snapshotSenders  map[uint64]*snapshotSender // snapshot sending to nodes.
+	snapshotReceiver *snapshotReceiver          // snapshot receiving from leader.
+
 	// Other fields.
-	maxSizePerMsg uint
-	readOnly      *read.ReadOnly
-	callback      application
+	maxSizePerMsg  uint
+	readOnly       *read.ReadOnly
+	readOnlyOption conf.ReadOnlyOption
+	callback       application
 }
 
 func makeCore(config *conf.Config, callback application) *core {
@@ -79,15 +102,11 @@ func makeCore(config *conf.Config, callback application) *core {
 	c.leaderID = conf.InvalidID
 	c.state = RoleFollower
 
-	/* make nodes */
-	c.nodes = make([]*peer.Node, 0)
-	lastIndex := c.log.LastIndex()
-	for i := 0; i < len(config.Nodes); i++ {
-		if config.Nodes[i] != c.id {
-			node := peer.MakeNode(c.id, config.Nodes[i], lastIndex+1)
-			c.nodes = append(c.nodes, node)
-		}
-	}
+	c.restoreConfState(&raftpd.ConfState{
+		Nodes:         config.Nodes,
+		Learners:      config.Learners,
+		OutgoingNodes: config.OutgoingNodes,
+	})
 
 	// Initialize time rl fields.
 	c.timeElapsed = 0
@@ -98,8 +117,17 @@ func makeCore(config *conf.Config, callback application) *core {
 	// member-ship change fields.
 	c.pendingConf = false
 
+	// leader transfer fields.
+	c.leadTransferee = conf.InvalidID
+	c.transferElapsed = 0
+
+	// snapshot transfer fields.
+	c.snapshotSenders = make(map[uint64]*snapshotSender)
+	c.snapshotReceiver = nil
+
 	c.callback = callback
 	c.readOnly = read.MakeReadOnly()
+	c.readOnlyOption = config.ReadOnlyOption
 	c.maxSizePerMsg = config.MaxSizePreMsg
 
 	utils.Assert(c.log.LastIndex() >= c.log.CommitIndex(),
@@ -129,20 +157,53 @@ func (c *core) ReadHardState() raftpd.HardState {
 }
 
 func (c *core) ReadConfState() raftpd.ConfState {
-	state := raftpd.ConfState{}
-	state.Nodes = make([]uint64, len(c.nodes)+1)
-	state.Nodes[len(c.nodes)] = c.id
+	state := raftpd.ConfState{
+		Nodes:         make([]uint64, len(c.voters)),
+		Learners:      make([]uint64, 0),
+		OutgoingNodes: make([]uint64, len(c.outgoing)),
+	}
+	copy(state.Nodes, c.voters)
+	copy(state.OutgoingNodes, c.outgoing)
 	for i := 0; i < len(c.nodes); i++ {
-		state.Nodes[i] = c.nodes[i].ID
+		if c.nodes[i].Learner {
+			state.Learners = append(state.Learners, c.nodes[i].ID)
+		}
+	}
+	if c.isLearner {
+		state.Learners = append(state.Learners, c.id)
 	}
 	return state
 }
 
+// Status return a snapshot of raft status, except applied index.
+func (c *core) Status() Status {
+	status := Status{
+		ID:             c.id,
+		HardState:      c.ReadHardState(),
+		SoftState:      c.ReadSoftState(),
+		ConfState:      c.ReadConfState(),
+		LeadTransferee: c.leadTransferee,
+	}
+	if c.state.IsLeader() {
+		status.Progress = make(map[uint64]peer.Progress, len(c.nodes))
+		for i := 0; i < len(c.nodes); i++ {
+			status.Progress[c.nodes[i].ID] = c.nodes[i].Progress(c.electionTick)
+		}
+	}
+	return status
+}
+
 func (c *core) Propose(bytes []byte) (index uint64, term uint64, isLeader bool) {
 	if !c.state.IsLeader() {
 		return conf.InvalidIndex, conf.InvalidTerm, false
 	}
 
+	if c.leadTransferee != conf.InvalidID {
+		log.Debugf("%d [term: %d] transfer leadership to %d is in progress; dropping proposal",
+			c.id, c.term, c.leadTransferee)
+		return conf.InvalidIndex, conf.InvalidTerm, false
+	}
+
 	entry := raftpd.Entry{
 		Index: c.log.LastIndex() + 1,
 		Term:  c.term,
@@ -235,15 +296,37 @@ func (c *core) Step(msg *raftpd.Message) {
 
 func (c *core) Periodic(millsSinceLastPeriod int) {
 	c.timeElapsed += millsSinceLastPeriod
+	c.clock += millsSinceLastPeriod
 	log.Debugf("%d periodic %d, time elapsed %d", c.id, millsSinceLastPeriod, c.timeElapsed)
 
 	if c.state.IsLeader() {
+		for i := 0; i < len(c.nodes); i++ {
+			node := c.nodes[i]
+			node.Elapse(millsSinceLastPeriod)
+			// transport may lose snapshot chunks without reporting,
+			// so abort transfer if no chunk acked in an election timeout.
+			if node.SnapshotTimeout(c.electionTick) {
+				log.Infof("%d [term: %d] abort sending snapshot to %d because of timeout",
+					c.id, c.term, node.ID)
+				c.ReportSnapshot(node.ID, SnapshotFailure)
+			}
+		}
+		if c.leadTransferee != conf.InvalidID {
+			c.transferElapsed += millsSinceLastPeriod
+			// Abort leader transfer when target could not
+			// take over leadership in an election timeout.
+			if c.transferElapsed >= c.electionTick {
+				log.Infof("%d [term: %d] abort transfer leadership to %d because of timeout",
+					c.id, c.term, c.leadTransferee)
+				c.abortLeaderTransfer()
+			}
+		}
 		if c.heartbeatTick <= c.timeElapsed {
 			c.broadcastAppend()
 			c.becomeLeader()
 		}
-	} else if c.randomizedElectionTick <= c.timeElapsed {
-		if len(c.nodes) > 1 {
+	} else if c.promotable() && c.randomizedElectionTick <= c.timeElapsed {
+		if !c.isSingleton() {
 			c.preCampaign()
 		} else {
 			// if there only one peer, just become leader.
@@ -255,44 +338,158 @@ func (c *core) Periodic(millsSinceLastPeriod int) {
 	c.applyEntries()
 }
 
+// TransferLeader try to transfer leadership to node `transferee`. Leader
+// will stop accepting proposals, catch transferee up, and then tell it
+// to campaign immediately. If transferee could not become leader in an
+// election timeout, the transfer will be aborted.
+func (c *core) TransferLeader(transferee uint64) {
+	if !c.state.IsLeader() {
+		log.Debugf("%d [term: %d] ignore transfer leadership to %d, because it isn't leader",
+			c.id, c.term, transferee)
+		return
+	}
+
+	if transferee == c.id {
+		log.Debugf("%d [term: %d] is already leader, ignore transfer leadership to itself",
+			c.id, c.term)
+		return
+	}
+
+	node := c.getNodeByID(transferee)
+	if node == nil {
+		log.Debugf("%d [term: %d] ignore transfer leadership to unknown node %d",
+			c.id, c.term, transferee)
+		return
+	}
+
+	if !containsID(c.voters, transferee) {
+		log.Debugf("%d [term: %d] ignore transfer leadership to non voter %d",
+			c.id, c.term, transferee)
+		return
+	}
+
+	if c.leadTransferee != conf.InvalidID {
+		if c.leadTransferee == transferee {
+			log.Debugf("%d [term: %d] transfer leadership to %d is in progress, ignore request",
+				c.id, c.term, transferee)
+			return
+		}
+		c.abortLeaderTransfer()
+	}
+
+	log.Infof("%d [term: %d] starts to transfer leadership to %d", c.id, c.term, transferee)
+
+	c.leadTransferee = transferee
+	c.transferElapsed = 0
+	if node.Matched == c.log.LastIndex() {
+		c.sendTimeoutNow(node)
+	} else {
+		// catch transferee up first, send timeout now
+		// message after it's log become up-to-date.
+		c.replicate(node)
+	}
+}
+
 func (c *core) ProposeConfChange(cc *raftpd.ConfChange) (
 	index uint64, term uint64, isLeader bool) {
 	if !c.state.IsLeader() {
 		return conf.InvalidIndex, conf.InvalidTerm, false
 	}
 
-	if c.pendingConf {
-		log.Infof("propose conf ignored since pending unapplied configuration")
+	if c.leadTransferee != conf.InvalidID {
+		log.Debugf("%d [term: %d] transfer leadership to %d is in progress; dropping conf change",
+			c.id, c.term, c.leadTransferee)
+		return conf.InvalidIndex, conf.InvalidTerm, false
 	}
-	c.pendingConf = true
 
-	entry := raftpd.Entry{
-		Index: c.log.LastIndex() + 1,
-		Term:  c.term,
-		Type:  raftpd.EntryConfChange,
-		Data:  pd.MustMarshal(cc),
+	if c.outgoing != nil && cc.ChangeType != raftpd.ConfChangeLeaveJoint {
+		log.Infof("%d [term: %d] propose conf ignored since in joint consensus",
+			c.id, c.term)
+		return conf.InvalidIndex, conf.InvalidTerm, false
 	}
 
-	// Leader Append-Only: a leader never overwrites or deletes
-	// entries in its log; it only appends new entries. §5.3
-	c.log.Append([]raftpd.Entry{entry})
+	// at most one uncommitted conf entry is allowed, including the
+	// leave joint appended automatically after entering joint.
+	if c.pendingConf {
+		log.Infof("%d [term: %d] propose conf ignored since pending unapplied configuration",
+			c.id, c.term)
+		return conf.InvalidIndex, conf.InvalidTerm, false
+	}
+
+	index, term = c.appendConfChange(cc)
 
 	// broadcast append info immediately.
 	c.broadcastAppend()
 
-	return entry.Index, entry.Term, true
+	return index, term, true
 }
 
 func (c *core) ApplyConfChange(cc *raftpd.ConfChange) raftpd.ConfState {
 	switch cc.ChangeType {
 	case raftpd.ConfChangeAddNode:
-		c.addNode(cc.NodeID)
+		c.addNode(cc.NodeID, false)
+	case raftpd.ConfChangeLearnerNode:
+		c.addNode(cc.NodeID, true)
+	case raftpd.ConfChangePromoteNode:
+		c.promoteNode(cc.NodeID)
 	case raftpd.ConfChangeRemoveNode:
 		c.removeNode(cc.NodeID)
+	case raftpd.ConfChangeEnterJoint:
+		c.enterJoint(cc.AddNodes, cc.RemoveNodes)
+	case raftpd.ConfChangeLeaveJoint:
+		c.leaveJoint()
 	}
 	return c.ReadConfState()
 }
 
+// ReportSnapshot report the result of snapshot sending to node. Leader
+// will probe node from the entry after snapshot if finished, otherwise
+// resend snapshot later.
+func (c *core) ReportSnapshot(nodeID uint64, status SnapshotStatus) {
+	if !c.state.IsLeader() {
+		return
+	}
+
+	node := c.getNodeByID(nodeID)
+	if node == nil {
+		return
+	}
+
+	log.Debugf("%d [term: %d] snapshot sent to %d reported: %v",
+		c.id, c.term, nodeID, status)
+
+	c.closeSnapshotSender(nodeID)
+	node.ReportSnapshot(status == SnapshotFinish)
+}
+
+// StableTo notice that entries up to index have been saved to
+// stable storage, so they could be committed and applied.
+func (c *core) StableTo(index, term uint64) {
+	if !c.log.StableTo(index, term) {
+		return
+	}
+	if c.state.IsLeader() {
+		c.maybeCommit()
+	}
+	c.applyEntries()
+}
+
 func (c *core) ApplySnapshot(metadata *raftpd.SnapshotMetadata) {
 	c.log.CompactTo(metadata.Index, metadata.Term)
 }
+
+// Compact discard entries before index, which must have been applied
+// by state machine. It returns metadata of the new first entry, and
+// false if there is nothing to discard.
+func (c *core) Compact(index uint64) (raftpd.SnapshotMetadata, bool) {
+	if index < c.log.FirstIndex() || index > c.log.CommitIndex() {
+		return raftpd.SnapshotMetadata{}, false
+	}
+
+	metadata := raftpd.SnapshotMetadata{
+		Index: index,
+		Term:  c.log.Term(index),
+	}
+	c.log.CompactTo(metadata.Index, metadata.Term)
+	return metadata, true
+}
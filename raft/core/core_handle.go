@@ -10,6 +10,14 @@ import (
 )
 
 func (c *core) stepLeader(msg *raftpd.Message) {
+	// Record responses from followers, to report whether they are active.
+	switch msg.MsgType {
+	case raftpd.MsgHeartbeatResponse, raftpd.MsgAppendResponse, raftpd.MsgSnapshotResponse:
+		if node := c.getNodeByID(msg.From); node != nil {
+			node.MarkActive()
+		}
+	}
+
 	switch msg.MsgType {
 	case raftpd.MsgHeartbeatResponse:
 		c.handleHeartbeatResponse(msg)
@@ -38,6 +46,13 @@ func (c *core) stepFollower(msg *raftpd.Message) {
 	case raftpd.MsgSnapshotRequest:
 		c.becomeFollower(c.term, msg.From)
 		c.handleSnapshot(msg)
+	case raftpd.MsgTimeoutNowRequest:
+		if !c.promotable() {
+			log.Infof("%d [term: %d] non voter ignore timeout now from %d",
+				c.id, c.term, msg.From)
+			return
+		}
+		c.handleTimeoutNow(msg)
 	}
 }
 
@@ -92,9 +107,16 @@ func (c *core) handleReadIndexRequest(msg *raftpd.Message) {
 		return
 	}
 
-	c.readOnly.AddRequest(c.log.CommitIndex(), msg.From, msg.Context)
+	if c.readOnlyOption == conf.ReadOnlyLeaseBased && c.inLease() {
+		// No other leader could be elected during lease,
+		// so commit index is up-to-date. (raft thesis 6.4.1)
+		c.responseReadIndex(msg.From, c.log.CommitIndex(), msg.Context)
+		return
+	}
 
-	if c.quorum() > 1 {
+	c.readOnly.AddRequest(c.log.CommitIndex(), msg.From, c.clock, msg.Context)
+
+	if !c.isSingleton() {
 		c.broadcastHeartbeatWithCtx(msg.Context)
 	} else {
 		c.advanceReadOnly(msg.Context)
@@ -164,6 +186,20 @@ func (c *core) handleAppendEntriesResponse(msg *raftpd.Message) {
 	if successAppend {
 		c.poll(node.Matched)
 	}
+	if !msg.Reject {
+		c.maybeSendTimeoutNow(node)
+	}
+}
+
+// maybeSendTimeoutNow tell transferee to campaign immediately if it has
+// caught up. It is called on every response from transferee, because
+// timeout now message might be lost.
+func (c *core) maybeSendTimeoutNow(node *peer.Node) {
+	if node.ID == c.leadTransferee && node.Matched == c.log.LastIndex() {
+		log.Infof("%d [term: %d] sent timeout now to %d after it has caught up",
+			c.id, c.term, node.ID)
+		c.sendTimeoutNow(node)
+	}
 }
 
 func (c *core) tryRestore(snapshot *raftpd.Snapshot) bool {
@@ -187,34 +223,65 @@ func (c *core) handleSnapshot(msg *raftpd.Message) {
 		MsgType: raftpd.MsgSnapshotResponse,
 		To:      msg.From,
 		Reject:  false,
+		Index:   msg.Snapshot.Metadata.Index,
+	}
+	if !c.tryRestore(msg.Snapshot) {
+		log.Debugf("%x [commit: %d] ignored snapshot [index: %d, term: %d]",
+			c.id, c.log.CommitIndex(),
+			msg.Snapshot.Metadata.Index, msg.Snapshot.Metadata.Term)
+
+		if c.snapshotReceiver != nil &&
+			sameSnapshot(&c.snapshotReceiver.metadata, &msg.Snapshot.Metadata) {
+			c.abortSnapshotReceiver()
+		}
+		reply.Done = true
+		reply.RejectHint = c.log.CommitIndex()
+		c.send(&reply)
+		return
 	}
-	if c.tryRestore(msg.Snapshot) {
+
+	offset, done := c.receiveSnapshotChunk(msg)
+	reply.Offset = offset
+	if done {
 		log.Debugf("%x [commit: %d] restore snapshot [index: %d, term: %d]",
 			c.id, c.log.CommitIndex(),
 			msg.Snapshot.Metadata.Index, msg.Snapshot.Metadata.Term)
 
 		// FIXME: maybe blocked or compact before it return.
-		c.callback.applySnapshot(msg.Snapshot)
+		c.callback.restoreSnapshot(&msg.Snapshot.Metadata)
 		c.ApplySnapshot(&msg.Snapshot.Metadata)
+		// configuration of snapshot replaces the one of entries discarded,
+		// snapshot built without configuration keeps current one.
+		if len(msg.Snapshot.Metadata.ConfState.Nodes) != 0 {
+			c.restoreConfState(&msg.Snapshot.Metadata.ConfState)
+		}
 
-		reply.Index = msg.Snapshot.Metadata.Index
+		reply.Done = true
 		reply.RejectHint = c.log.LastIndex()
-	} else {
-		log.Debugf("%x [commit: %d] ignored snapshot [index: %d, term: %d]",
-			c.id, c.log.CommitIndex(),
-			msg.Snapshot.Metadata.Index, msg.Snapshot.Metadata.Term)
-
-		reply.Index = msg.Snapshot.Metadata.Index
-		reply.RejectHint = c.log.CommitIndex()
 	}
 	c.send(&reply)
 }
 
 func (c *core) handleSnapshotResponse(msg *raftpd.Message) {
-	log.Debugf("%d received snapshot response from %d [rj: %v, idx: %d, hint: %d]",
-		c.id, msg.From, msg.Reject, msg.Index, msg.RejectHint)
+	log.Debugf("%d received snapshot response from %d [rj: %v, idx: %d, hint: %d, "+
+		"offset: %d, done: %v]", c.id, msg.From, msg.Reject, msg.Index, msg.RejectHint,
+		msg.Offset, msg.Done)
 
 	node := c.getNodeByID(msg.From)
+	if node == nil {
+		return
+	}
+
+	if !msg.Done && !msg.Reject {
+		if node.HandleSnapshotChunk(msg.Index, msg.Offset) {
+			c.sendSnapshotChunk(node)
+		}
+		return
+	}
+
+	if sender, ok := c.snapshotSenders[msg.From]; ok && sender.metadata.Index == msg.Index {
+		c.closeSnapshotSender(msg.From)
+	}
 	node.HandleSnapshot(msg.Reject, msg.Index, msg.RejectHint)
 }
 
@@ -222,10 +289,20 @@ func (c *core) handleUnreachable(msg *raftpd.Message) {
 	node := c.getNodeByID(msg.From)
 
 	node.HandleUnreachable()
+	c.closeSnapshotSender(msg.From)
 	log.Infof("%d failed to send message to %d"+
 		" because it is unreachable", c.id, msg.From)
 }
 
+// handleTimeoutNow campaign immediately without pre vote, because
+// leader has stopped accepting proposals and wait us take over leadership.
+func (c *core) handleTimeoutNow(msg *raftpd.Message) {
+	log.Infof("%d [term: %d] received timeout now from %d and starts an election "+
+		"to get leadership", c.id, c.term, msg.From)
+
+	c.campaign()
+}
+
 func (c *core) handleHeartbeat(msg *raftpd.Message) {
 	log.Debugf("%d [term: %d] handle heartbeat request from %d", c.id, c.term, msg.From)
 
@@ -242,8 +319,20 @@ func (c *core) handleHeartbeat(msg *raftpd.Message) {
 
 func (c *core) handleHeartbeatResponse(msg *raftpd.Message) {
 	log.Debugf("%d [term: %d] handle heartbeat response from %d", c.id, c.term, msg.From)
-	ackCount := c.readOnly.ReceiveAck(msg.From, msg.Context)
-	if ackCount < c.quorum() {
+	if node := c.getNodeByID(msg.From); node != nil {
+		c.maybeSendTimeoutNow(node)
+	}
+
+	acks := c.readOnly.ReceiveAck(msg.From, msg.Context)
+	if acks == nil {
+		return
+	}
+	acked := func(nodeID uint64) bool {
+		_, ok := acks[nodeID]
+		/* include an ack from local node */
+		return ok || nodeID == c.id
+	}
+	if !c.reachQuorum(acked) {
 		return
 	}
 	log.Debugf("%d [term: %d] handle heartbeat response from %d", c.id, c.term, msg.From)
@@ -251,14 +340,16 @@ func (c *core) handleHeartbeatResponse(msg *raftpd.Message) {
 	c.advanceReadOnly(msg.Context)
 }
 
-func (c *core) voteStateCount(state peer.VoteState) int {
-	var count = 0
-	for i := 0; i < len(c.nodes); i++ {
-		if c.nodes[i].Vote == state {
-			count++
+// voteStateIs return a function test whether vote state of node is `state`,
+// self is always granted.
+func (c *core) voteStateIs(state peer.VoteState) func(nodeID uint64) bool {
+	return func(nodeID uint64) bool {
+		if nodeID == c.id {
+			return state == peer.VoteGranted
 		}
+		node := c.getNodeByID(nodeID)
+		return node != nil && node.Vote == state
 	}
-	return count
 }
 
 func (c *core) handlePreVote(msg *raftpd.Message) {
@@ -333,9 +424,7 @@ func (c *core) handleVoteResponse(msg *raftpd.Message) {
 	node := c.getNodeByID(msg.From)
 	node.UpdateVoteState(msg.Reject)
 
-	/* self has one */
-	count := c.voteStateCount(peer.VoteGranted) + 1
-	if count >= c.quorum() {
+	if c.reachQuorum(c.voteStateIs(peer.VoteGranted)) {
 		if msg.MsgType == raftpd.MsgVoteResponse {
 			log.Infof("%d [term: %d] win campaign", c.id, c.term)
 			c.becomeLeader()
@@ -346,9 +435,10 @@ func (c *core) handleVoteResponse(msg *raftpd.Message) {
 		return
 	}
 
-	// return to follower state if it receives vote denial from a majority
-	count = c.voteStateCount(peer.VoteReject)
-	if count >= c.quorum() {
+	// return to follower state if it receives vote denial from a majority,
+	// which means that the rest nodes could not reach quorum.
+	rejected := c.voteStateIs(peer.VoteReject)
+	if !c.reachQuorum(func(nodeID uint64) bool { return !rejected(nodeID) }) {
 		c.backToFollower(msg.Term, conf.InvalidID)
 	}
 }
@@ -385,25 +475,28 @@ func (c *core) broadcastAppend() {
 
 	log.Debugf("%d broadcast message at term: %d [%d, %d]",
 		c.id, c.term, firstIndex, lastIndex)
-	if c.quorum() <= 1 {
-		// there only one node in current cluster, so no responses will return,
+	if c.isSingleton() {
+		// there only one voter in current cluster, so no responses will return,
 		// just commit all entries directly.
 		c.poll(lastIndex)
-	} else {
-		for i := 0; i < len(c.nodes); i++ {
-			node := c.nodes[i]
-			/* ignore paused node */
-			if node.IsPaused() {
-				continue
-			}
+	}
+	for i := 0; i < len(c.nodes); i++ {
+		c.replicate(c.nodes[i])
+	}
+}
 
-			if node.NextIdx >= firstIndex {
-				c.sendAppend(node)
-			} else {
-				// send snapshot if we failed to get term or entries
-				c.sendSnapshot(node)
-			}
-		}
+// replicate send append or snapshot to node, if it isn't paused.
+func (c *core) replicate(node *peer.Node) {
+	/* ignore paused node */
+	if node.IsPaused() {
+		return
+	}
+
+	if node.NextIdx >= c.log.FirstIndex() {
+		c.sendAppend(node)
+	} else {
+		// send snapshot if we failed to get term or entries
+		c.sendSnapshot(node)
 	}
 }
 
@@ -457,29 +550,10 @@ func (c *core) sendAppend(node *peer.Node) {
 	c.send(&msg)
 }
 
-func (c *core) sendSnapshot(node *peer.Node) {
-	snapshot := c.callback.readSnapshot()
-
-	// if snapshot is building at now, it will return nil,
-	// so just ignore it and send message to it on next tick.
-	if snapshot == nil {
-		log.Debugf("%x failed to send snapshot to %x because snapshot "+
-			"is temporarily unavailable", c.id, node.ID)
-		return
-	}
-
-	log.Debugf("%x [firstIdx: %d, commit: %d] send "+
-		"snapshot[index: %d, term: %d] to %x", c.id, c.log.FirstIndex(), c.log.CommitIndex(),
-		snapshot.Metadata.Index, snapshot.Metadata.Term, node.ID)
-
-	node.SendSnapshot(snapshot.Metadata.Index)
-
-	log.Debugf("%x paused sending replication messages to %x", c.id, node.ID)
-
+func (c *core) sendTimeoutNow(node *peer.Node) {
 	msg := raftpd.Message{
-		MsgType:  raftpd.MsgSnapshotRequest,
-		To:       node.ID,
-		Snapshot: snapshot,
+		MsgType: raftpd.MsgTimeoutNowRequest,
+		To:      node.ID,
 	}
 
 	c.send(&msg)
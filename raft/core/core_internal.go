@@ -9,6 +9,7 @@ import (
 	"github.com/thinkermao/bior/raft/core/read"
 	"github.com/thinkermao/bior/raft/proto"
 	"github.com/thinkermao/bior/utils"
+	"github.com/thinkermao/bior/utils/pd"
 )
 
 func quorum(len int) int {
@@ -49,6 +50,7 @@ func (c *core) reset(term uint64) {
 	if c.term != term {
 		c.term = term
 		c.vote = conf.InvalidID
+		c.leaseExpire = 0
 	}
 	c.leaderID = conf.InvalidID
 	c.resetLease()
@@ -60,6 +62,8 @@ func (c *core) becomeFollower(term, leaderID uint64) {
 	c.leaderID = leaderID
 	c.state = RoleFollower
 	c.vote = leaderID
+	c.abortLeaderTransfer()
+	c.closeSnapshotSenders()
 
 	if leaderID != conf.InvalidID {
 		log.Debugf("%v become %d's follower at %d", c.id, leaderID, c.term)
@@ -75,6 +79,7 @@ func (c *core) becomeLeader() {
 	c.reset(c.term)
 	c.leaderID = c.id
 	c.state = RoleLeader
+	c.abortSnapshotReceiver()
 
 	num := c.numOfPendingConf()
 	if num > 1 {
@@ -144,9 +149,13 @@ func (c *core) campaign() {
 	c.sendToNodes(&msg)
 }
 
+// sendToNodes send msg to all voters, learners are ignored.
 func (c *core) sendToNodes(msg *raftpd.Message) {
 	for i := 0; i < len(c.nodes); i++ {
 		node := c.nodes[i]
+		if !c.isVoter(node.ID) {
+			continue
+		}
 		msg.To = node.ID
 
 		log.Debugf("%x [term: %d, index: %d] send %v request to %x at term %d",
@@ -155,8 +164,68 @@ func (c *core) sendToNodes(msg *raftpd.Message) {
 	}
 }
 
-func (c *core) quorum() int {
-	return quorum(len(c.nodes) + 1)
+// isVoter test whether node is voter of current or old configuration.
+func (c *core) isVoter(nodeID uint64) bool {
+	return containsID(c.voters, nodeID) || containsID(c.outgoing, nodeID)
+}
+
+// promotable test whether self could be promoted to leader.
+func (c *core) promotable() bool {
+	return c.isVoter(c.id)
+}
+
+// isSingleton test whether self is the only one voter.
+func (c *core) isSingleton() bool {
+	return len(c.outgoing) == 0 && len(c.voters) == 1 && c.voters[0] == c.id
+}
+
+// reachQuorum test whether nodes accepted by `accept` are majority
+// of voters. In joint consensus, it requires majority of both current
+// and old configurations.
+func (c *core) reachQuorum(accept func(nodeID uint64) bool) bool {
+	return isMajority(c.voters, accept) && isMajority(c.outgoing, accept)
+}
+
+func isMajority(voters []uint64, accept func(nodeID uint64) bool) bool {
+	if len(voters) == 0 {
+		/* empty configuration always agrees */
+		return true
+	}
+
+	count := 0
+	for i := 0; i < len(voters); i++ {
+		if accept(voters[i]) {
+			count++
+		}
+	}
+	return count >= quorum(len(voters))
+}
+
+func containsID(ids []uint64, id uint64) bool {
+	for i := 0; i < len(ids); i++ {
+		if ids[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// appendID append id to ids if it isn't exists.
+func appendID(ids []uint64, id uint64) []uint64 {
+	if containsID(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
+
+// removeID remove id from ids, and keep order of others.
+func removeID(ids []uint64, id uint64) []uint64 {
+	for i := 0; i < len(ids); i++ {
+		if ids[i] == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
 }
 
 // commit all could commit
@@ -168,18 +237,31 @@ func (c *core) poll(idx uint64) {
 		/* maybe committed, or old Term's log entry */
 		return
 	}
-	count := 1
-	for i := 0; i < len(c.nodes); i++ {
-		if c.nodes[i].Matched >= idx {
-			count++
+	matched := func(nodeID uint64) bool {
+		if nodeID == c.id {
+			// leader's entries might be saved in parallel with
+			// replication, so count it after stabled (§10.2.1).
+			return c.log.LastStabled() >= idx
 		}
+		node := c.getNodeByID(nodeID)
+		return node != nil && node.Matched >= idx
 	}
 
-	if count >= c.quorum() {
+	if c.reachQuorum(matched) {
 		c.log.CommitTo(idx)
 	}
 }
 
+// maybeCommit commit entries replicated by followers, but
+// not committed because they are stabled by leader later.
+func (c *core) maybeCommit() {
+	stabled := c.log.LastStabled()
+	c.poll(stabled)
+	for i := 0; i < len(c.nodes); i++ {
+		c.poll(utils.MinUint64(c.nodes[i].Matched, stabled))
+	}
+}
+
 func (c *core) getNodeByID(nodeID uint64) *peer.Node {
 	for i := 0; i < len(c.nodes); i++ {
 		if c.nodes[i].ID == nodeID {
@@ -203,6 +285,14 @@ func (c *core) broadcastVictory() {
 
 	c.resetNodesProgress()
 
+	// previous leader may lose leadership before leaving joint
+	// consensus, so new leader is responsible to leave it.
+	if c.outgoing != nil && !c.pendingConf {
+		c.appendConfChange(&raftpd.ConfChange{
+			ChangeType: raftpd.ConfChangeLeaveJoint,
+		})
+	}
+
 	log.Debugf("%d [Term: %d] begin broadcast self's victory ", c.id, c.term)
 
 	c.broadcastAppend()
@@ -262,6 +352,36 @@ func (c *core) resetNodesProgress() {
 	nextIndex := c.nextIndex()
 	for i := 0; i < len(c.nodes); i++ {
 		c.nodes[i].ToProbe(nextIndex)
+		c.nodes[i].ResetActive()
+	}
+}
+
+// leaseDriftPercent is the percentage of election timeout subtracted
+// from lease, so that lease expires before followers' election timeout
+// even if clocks of nodes drift in a bounded rate.
+const leaseDriftPercent = 10
+
+// leaseTimeout return the time lease lasts since heartbeats sent.
+func (c *core) leaseTimeout() int {
+	return c.electionTick - c.electionTick*leaseDriftPercent/100
+}
+
+// inLease test whether leader is in lease, no other leader could
+// be elected if it is true.
+func (c *core) inLease() bool {
+	if c.leadTransferee != conf.InvalidID {
+		// transferee will campaign without pre vote.
+		return false
+	}
+	return c.clock < c.leaseExpire
+}
+
+// renewLease extend lease because a quorum has responded heartbeats
+// sent at time sent. Followers reset election timer after heartbeats
+// received, so lease is counted from sent, not from responses received.
+func (c *core) renewLease(sent int) {
+	if expire := sent + c.leaseTimeout(); expire > c.leaseExpire {
+		c.leaseExpire = expire
 	}
 }
 
@@ -287,23 +407,62 @@ func (c *core) numOfPendingConf() int {
 	return num
 }
 
-func (c *core) addNode(nodeID uint64) {
+func (c *core) addNode(nodeID uint64, isLearner bool) {
 	c.pendingConf = false
 
+	if c.id == nodeID {
+		/* do not add self to nodes */
+		if !isLearner && !c.isLearner {
+			c.voters = appendID(c.voters, nodeID)
+		}
+		return
+	}
+
 	// Ignore any redundant addNode calls (which can happen because the
 	// initial bootstrapping entries are applied twice).
 	var node = c.getNodeByID(nodeID)
-	if node != nil || c.id == nodeID {
-		/* do not add self to nodes */
+	if node != nil {
 		return
 	}
 	lastIndex := c.log.LastIndex()
-	c.nodes = append(c.nodes, peer.MakeNode(c.id, nodeID, lastIndex))
+	if isLearner {
+		c.nodes = append(c.nodes, peer.MakeLearner(c.id, nodeID, lastIndex))
+	} else {
+		c.voters = appendID(c.voters, nodeID)
+		c.nodes = append(c.nodes, peer.MakeNode(c.id, nodeID, lastIndex))
+	}
+}
+
+// promoteNode change learner to voter.
+func (c *core) promoteNode(nodeID uint64) {
+	c.pendingConf = false
+
+	if c.id == nodeID {
+		c.isLearner = false
+		c.voters = appendID(c.voters, nodeID)
+		return
+	}
+
+	node := c.getNodeByID(nodeID)
+	if node == nil {
+		log.Infof("%d [term: %d] ignore promote unknown node %d", c.id, c.term, nodeID)
+		return
+	}
+	node.Learner = false
+	c.voters = appendID(c.voters, nodeID)
 }
 
 func (c *core) removeNode(nodeID uint64) {
 	c.pendingConf = false
 
+	c.voters = removeID(c.voters, nodeID)
+	if !containsID(c.outgoing, nodeID) {
+		c.removeNodeProgress(nodeID)
+	}
+}
+
+// removeNodeProgress remove node from c.nodes.
+func (c *core) removeNodeProgress(nodeID uint64) {
 	for i := 0; i < len(c.nodes); i++ {
 		if c.nodes[i].ID != nodeID {
 			continue
@@ -313,34 +472,171 @@ func (c *core) removeNode(nodeID uint64) {
 			c.nodes[j] = c.nodes[j+1]
 		}
 		c.nodes = c.nodes[:len(c.nodes)-1]
+		c.closeSnapshotSender(nodeID)
+
+		// transferee has been removed, so leader transfer should be aborted.
+		if c.leadTransferee == nodeID {
+			c.abortLeaderTransfer()
+		}
 		return
 	}
 }
 
+// restoreConfState replace configuration by state, progress
+// of nodes is rebuilt from the entry after last index.
+func (c *core) restoreConfState(state *raftpd.ConfState) {
+	c.nodes = make([]*peer.Node, 0)
+	c.voters = make([]uint64, 0)
+	c.outgoing = nil
+	c.isLearner = false
+
+	nextIndex := c.nextIndex()
+	for i := 0; i < len(state.Nodes); i++ {
+		c.voters = appendID(c.voters, state.Nodes[i])
+		if state.Nodes[i] != c.id && c.getNodeByID(state.Nodes[i]) == nil {
+			c.nodes = append(c.nodes, peer.MakeNode(c.id, state.Nodes[i], nextIndex))
+		}
+	}
+	for i := 0; i < len(state.OutgoingNodes); i++ {
+		c.outgoing = appendID(c.outgoing, state.OutgoingNodes[i])
+		if state.OutgoingNodes[i] != c.id && c.getNodeByID(state.OutgoingNodes[i]) == nil {
+			c.nodes = append(c.nodes, peer.MakeNode(c.id, state.OutgoingNodes[i], nextIndex))
+		}
+	}
+	for i := 0; i < len(state.Learners); i++ {
+		if state.Learners[i] != c.id {
+			c.nodes = append(c.nodes, peer.MakeLearner(c.id, state.Learners[i], nextIndex))
+		} else {
+			c.isLearner = true
+		}
+	}
+}
+
+// enterJoint enter joint consensus C_old,new, new configuration
+// is current configuration add `adds` and remove `removes`.
+func (c *core) enterJoint(adds, removes []uint64) {
+	c.pendingConf = false
+
+	if c.outgoing != nil {
+		log.Infof("%d [term: %d] ignore enter joint since already in joint consensus",
+			c.id, c.term)
+		return
+	}
+
+	c.outgoing = make([]uint64, len(c.voters))
+	copy(c.outgoing, c.voters)
+
+	nextIndex := c.nextIndex()
+	for _, nodeID := range adds {
+		c.voters = appendID(c.voters, nodeID)
+		if nodeID == c.id {
+			c.isLearner = false
+		} else if node := c.getNodeByID(nodeID); node != nil {
+			node.Learner = false
+		} else {
+			c.nodes = append(c.nodes, peer.MakeNode(c.id, nodeID, nextIndex))
+		}
+	}
+	for _, nodeID := range removes {
+		c.voters = removeID(c.voters, nodeID)
+		if !containsID(c.outgoing, nodeID) {
+			/* learner is removed immediately */
+			c.removeNodeProgress(nodeID)
+		}
+	}
+
+	log.Infof("%d [term: %d] enter joint consensus, old: %v, new: %v",
+		c.id, c.term, c.outgoing, c.voters)
+
+	// leave joint consensus automatically after C_old,new is applied.
+	if c.state.IsLeader() {
+		c.appendConfChange(&raftpd.ConfChange{
+			ChangeType: raftpd.ConfChangeLeaveJoint,
+		})
+		c.broadcastAppend()
+	}
+}
+
+// leaveJoint leave joint consensus, change configuration to C_new.
+func (c *core) leaveJoint() {
+	c.pendingConf = false
+
+	if c.outgoing == nil {
+		/* redundant leave joint */
+		return
+	}
+
+	for _, nodeID := range c.outgoing {
+		if !containsID(c.voters, nodeID) && nodeID != c.id {
+			c.removeNodeProgress(nodeID)
+		}
+	}
+	c.outgoing = nil
+
+	log.Infof("%d [term: %d] leave joint consensus, new: %v", c.id, c.term, c.voters)
+
+	// leader isn't a member of C_new, step down.
+	if c.state.IsLeader() && !c.promotable() {
+		log.Infof("%d [term: %d] step down since removed from configuration", c.id, c.term)
+		c.becomeFollower(c.term, conf.InvalidID)
+	}
+}
+
+// appendConfChange append configuration change entry to log,
+// and returns index and term of the entry.
+func (c *core) appendConfChange(cc *raftpd.ConfChange) (uint64, uint64) {
+	c.pendingConf = true
+
+	entry := raftpd.Entry{
+		Index: c.log.LastIndex() + 1,
+		Term:  c.term,
+		Type:  raftpd.EntryConfChange,
+		Data:  pd.MustMarshal(cc),
+	}
+
+	// Leader Append-Only: a leader never overwrites or deletes
+	// entries in its log; it only appends new entries. §5.3
+	c.log.Append([]raftpd.Entry{entry})
+
+	return entry.Index, entry.Term
+}
+
+func (c *core) abortLeaderTransfer() {
+	c.leadTransferee = conf.InvalidID
+	c.transferElapsed = 0
+}
+
 func (c *core) advanceReadOnly(ctx []byte) {
 	rss := c.readOnly.Advance(ctx)
 	for _, rs := range rss {
-		if rs.To == c.id {
-			log.Debugf("%d [term: %d] save read state: %d, %v",
-				c.id, c.term, rs.Index, rs.Context)
+		c.renewLease(rs.Sent)
+		c.responseReadIndex(rs.To, rs.Index, rs.Context)
+	}
+}
 
-			readState := read.ReadState{
-				Index:      rs.Index,
-				RequestCtx: rs.Context,
-			}
+// responseReadIndex save read state if request is from self,
+// otherwise redirect it to the node which send request.
+func (c *core) responseReadIndex(to uint64, index uint64, ctx []byte) {
+	if to == c.id {
+		log.Debugf("%d [term: %d] save read state: %d, %v",
+			c.id, c.term, index, ctx)
 
-			c.callback.saveReadState(&readState)
-		} else {
-			log.Debugf("%d [term: %d] redirect heartbeat response %d to %d %v",
-				c.id, c.term, rs.Index, rs.To, rs.Context)
-
-			redirect := raftpd.Message{
-				To:      rs.To,
-				MsgType: raftpd.MsgReadIndexResponse,
-				Index:   rs.Index,
-				Context: rs.Context,
-			}
-			c.send(&redirect)
+		readState := read.ReadState{
+			Index:      index,
+			RequestCtx: ctx,
+		}
+
+		c.callback.saveReadState(&readState)
+	} else {
+		log.Debugf("%d [term: %d] redirect read index response %d to %d %v",
+			c.id, c.term, index, to, ctx)
+
+		redirect := raftpd.Message{
+			To:      to,
+			MsgType: raftpd.MsgReadIndexResponse,
+			Index:   index,
+			Context: ctx,
 		}
+		c.send(&redirect)
 	}
 }
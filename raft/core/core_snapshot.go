@@ -0,0 +1,242 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/core/peer"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// defaultSnapshotChunkSize is used if max size per message isn't set.
+const defaultSnapshotChunkSize = 1024 * 1024 // 1MB
+
+var errSnapshotRewind = errors.New("snapshot reader could not rewind")
+
+// snapshotSender holds the snapshot stream which is sending to a node,
+// snapshot is sent chunk by chunk, next chunk is sent after previous
+// one acked.
+type snapshotSender struct {
+	metadata raftpd.SnapshotMetadata
+	reader   io.ReadCloser
+	offset   uint64 // offset of next chunk read from reader.
+}
+
+// seek move reader to offset, it is used to resume transfer
+// from the offset acked by receiver.
+func (s *snapshotSender) seek(offset uint64) error {
+	if offset == s.offset {
+		return nil
+	}
+
+	if seeker, ok := s.reader.(io.Seeker); ok {
+		if _, err := seeker.Seek(int64(offset), io.SeekStart); err != nil {
+			return err
+		}
+		s.offset = offset
+		return nil
+	}
+
+	if offset < s.offset {
+		return errSnapshotRewind
+	}
+	n, err := io.CopyN(ioutil.Discard, s.reader, int64(offset-s.offset))
+	s.offset += uint64(n)
+	return err
+}
+
+// next read chunk of snapshot no more than size, done is
+// true if it is the last chunk.
+func (s *snapshotSender) next(size uint) (data []byte, done bool, err error) {
+	data = make([]byte, size)
+	n, err := io.ReadFull(s.reader, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		done, err = true, nil
+	}
+	s.offset += uint64(n)
+	return data[:n], done, err
+}
+
+// snapshotReceiver assembles snapshot chunks received from leader.
+type snapshotReceiver struct {
+	metadata raftpd.SnapshotMetadata
+	writer   io.WriteCloser
+	offset   uint64 // offset of next chunk expected.
+}
+
+func (c *core) snapshotChunkSize() uint {
+	if c.maxSizePerMsg == 0 {
+		return defaultSnapshotChunkSize
+	}
+	return c.maxSizePerMsg
+}
+
+func (c *core) sendSnapshot(node *peer.Node) {
+	metadata, reader := c.callback.openSnapshot()
+
+	// if snapshot is building at now, it will return nil, so ask
+	// application to build one, and send it to node on next tick.
+	if reader == nil {
+		log.Debugf("%x failed to send snapshot to %x because snapshot "+
+			"is temporarily unavailable", c.id, node.ID)
+		if node.RequestSnapshot(c.electionTick) {
+			log.Infof("%x request snapshot for %x [firstIdx: %d, next: %d]",
+				c.id, node.ID, c.log.FirstIndex(), node.NextIdx)
+			c.callback.requestSnapshot(node.ID)
+		}
+		return
+	}
+
+	log.Debugf("%x [firstIdx: %d, commit: %d] send "+
+		"snapshot[index: %d, term: %d] to %x", c.id, c.log.FirstIndex(), c.log.CommitIndex(),
+		metadata.Index, metadata.Term, node.ID)
+
+	c.closeSnapshotSender(node.ID)
+	node.SendSnapshot(metadata.Index)
+	c.snapshotSenders[node.ID] = &snapshotSender{
+		metadata: metadata,
+		reader:   reader,
+	}
+
+	log.Debugf("%x paused sending replication messages to %x", c.id, node.ID)
+
+	c.sendSnapshotChunk(node)
+}
+
+// sendSnapshotChunk send the chunk of pending snapshot
+// begins at the offset which node has acked.
+func (c *core) sendSnapshotChunk(node *peer.Node) {
+	sender, ok := c.snapshotSenders[node.ID]
+	if !ok {
+		return
+	}
+
+	offset := node.SnapshotOffset()
+	err := sender.seek(offset)
+	var data []byte
+	var done bool
+	if err == nil {
+		data, done, err = sender.next(c.snapshotChunkSize())
+	}
+	if err != nil {
+		log.Warnf("%x failed to read snapshot [index: %d, offset: %d] for %x: %v",
+			c.id, sender.metadata.Index, offset, node.ID, err)
+		c.closeSnapshotSender(node.ID)
+		node.HandleUnreachable()
+		return
+	}
+
+	log.Debugf("%x send snapshot chunk [index: %d, offset: %d, len: %d, done: %v] to %x",
+		c.id, sender.metadata.Index, offset, len(data), done, node.ID)
+
+	msg := raftpd.Message{
+		MsgType: raftpd.MsgSnapshotRequest,
+		To:      node.ID,
+		Snapshot: &raftpd.Snapshot{
+			Metadata: sender.metadata,
+			Data:     data,
+		},
+		Offset: offset,
+		Done:   done,
+	}
+
+	c.send(&msg)
+}
+
+func (c *core) closeSnapshotSender(nodeID uint64) {
+	sender, ok := c.snapshotSenders[nodeID]
+	if !ok {
+		return
+	}
+
+	delete(c.snapshotSenders, nodeID)
+	if err := sender.reader.Close(); err != nil {
+		log.Warnf("%x close snapshot [index: %d] reader of %x failed: %v",
+			c.id, sender.metadata.Index, nodeID, err)
+	}
+}
+
+func (c *core) closeSnapshotSenders() {
+	for nodeID := range c.snapshotSenders {
+		c.closeSnapshotSender(nodeID)
+	}
+}
+
+// receiveSnapshotChunk write chunk of msg to snapshot receiver, it returns
+// the next offset expected, and whether all chunks have been received.
+func (c *core) receiveSnapshotChunk(msg *raftpd.Message) (uint64, bool) {
+	metadata := msg.Snapshot.Metadata
+	if c.snapshotReceiver != nil && !sameSnapshot(&c.snapshotReceiver.metadata, &metadata) {
+		/* leader sends another snapshot */
+		c.abortSnapshotReceiver()
+	}
+
+	if c.snapshotReceiver == nil {
+		if msg.Offset != 0 {
+			/* lost the beginning, ask leader to send from start */
+			return 0, false
+		}
+
+		writer, err := c.callback.createSnapshot(&metadata)
+		if err != nil {
+			log.Warnf("%x create snapshot [index: %d, term: %d] failed: %v",
+				c.id, metadata.Index, metadata.Term, err)
+			return 0, false
+		}
+		c.snapshotReceiver = &snapshotReceiver{
+			metadata: metadata,
+			writer:   writer,
+		}
+	}
+
+	receiver := c.snapshotReceiver
+	if msg.Offset != receiver.offset {
+		// resume from the offset received, or
+		// ask leader resend lost chunks.
+		log.Debugf("%x [offset: %d] ignore snapshot chunk [index: %d, offset: %d]",
+			c.id, receiver.offset, metadata.Index, msg.Offset)
+		return receiver.offset, false
+	}
+
+	if _, err := receiver.writer.Write(msg.Snapshot.Data); err != nil {
+		log.Warnf("%x write snapshot [index: %d, offset: %d] failed: %v",
+			c.id, metadata.Index, msg.Offset, err)
+		c.abortSnapshotReceiver()
+		return 0, false
+	}
+	receiver.offset += uint64(len(msg.Snapshot.Data))
+	if !msg.Done {
+		return receiver.offset, false
+	}
+
+	c.snapshotReceiver = nil
+	if err := receiver.writer.Close(); err != nil {
+		log.Warnf("%x close snapshot [index: %d] writer failed: %v",
+			c.id, metadata.Index, err)
+		return 0, false
+	}
+	return receiver.offset, true
+}
+
+// sameSnapshot test whether a and b describe the same snapshot.
+func sameSnapshot(a, b *raftpd.SnapshotMetadata) bool {
+	return a.Index == b.Index && a.Term == b.Term
+}
+
+func (c *core) abortSnapshotReceiver() {
+	receiver := c.snapshotReceiver
+	if receiver == nil {
+		return
+	}
+
+	log.Debugf("%x abort snapshot [index: %d, term: %d] at offset: %d",
+		c.id, receiver.metadata.Index, receiver.metadata.Term, receiver.offset)
+
+	c.snapshotReceiver = nil
+	if err := receiver.writer.Close(); err != nil {
+		log.Warnf("%x close snapshot [index: %d] writer failed: %v",
+			c.id, receiver.metadata.Index, err)
+	}
+}
@@ -4,7 +4,9 @@
 // must implement `NodeApplication` interface call by raft. On the same time,
 // caller must periodic call `Raft.Periodic` in stable time interval, call
 // `Raft.Ready` to achieve ready data, and dispatch them. Such as persistence
-// unstabled raft log entries, send raft entries to other nodes.
+// unstabled raft log entries, send raft entries to other nodes. Entries are
+// not stabled until `Raft.Advance` or `Raft.StableTo` called after persistence,
+// so that storage could be written by other goroutine.
 //
 // Basic usage for `Raft` must be `Propose`, call it and pass binary data,
 // and data will appear at `Ready.commitEntries` when majority nodes has been
@@ -13,6 +15,8 @@
 //
 // `Raft` provides read-only queries that are not distributed through the log,
 // you can call `Raft.Read` pass unique ID as `context` for the read-only query.
+// Entries could be applied asynchronously, call `Raft.AppliedTo` after that, and
+// read states will appear at `Ready.ReadStates` once they could be served.
 //
 // Of course, there will be received some data from others node, should call
 // `Raft.Step` to handle it.
@@ -22,7 +26,9 @@
 // 	when change has been reached state machine, then call `ApplyConfChange` notice raft
 // 	apply change.
 // 	- when raft call `NodeApplication.applySnapshot`, after persistence snapshot,
-// 	should call `Raft.ApplySnapshot`, let it rebuild log information.
+// 	should call `Raft.ApplySnapshot`, let it rebuild log information. Snapshot
+// 	is sent in chunks, implements `SnapshotStreamer` to avoid holding whole
+// 	snapshot in memory.
 // 	- IMPORTANT: state machine should use something check alive mechanism like
 //  heartbeat, and report dropped of nodes of raft group by call `Raft.Unreachable(id)`.
 package core
@@ -1,8 +1,6 @@
 package holder
 
 import (
-	"fmt"
-
 	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/proto"
 	"github.com/thinkermao/bior/utils"
@@ -218,18 +216,20 @@ func (holder *LogHolder) ApplyEntries() []raftpd.Entry {
 	return result
 }
 
-// StableEntries mark all entries[stable:] as stabled,
-// and return the entries need to stabled.
-func (holder *LogHolder) StableEntries() []raftpd.Entry {
-	lastStabled := holder.lastStabled
-	lastIndex := holder.LastIndex()
-	utils.Assert(lastStabled <= lastIndex,
-		fmt.Sprintf("%d stabled: %d, lastIndex: %d",
-			holder.id, lastStabled, lastIndex))
+// LastStabled return the index of last entry has been stabled.
+func (holder *LogHolder) LastStabled() uint64 {
+	return holder.lastStabled
+}
 
-	entries := holder.Slice(lastStabled+1, lastIndex+1)
-	holder.lastStabled = lastIndex
-	return entries
+// StableTo mark entries[:index] as stabled if entry at index still
+// has term, it returns false if entries are truncated or stabled before.
+func (holder *LogHolder) StableTo(index, term uint64) bool {
+	if index <= holder.lastStabled || index > holder.LastIndex() ||
+		holder.Term(index) != term {
+		return false
+	}
+	holder.lastStabled = index
+	return true
 }
 
 // TryAppend check whether log is valid. if valid, it append entries,
@@ -240,22 +240,32 @@ func TestLogHolder_Slice(t *testing.T) {
 	}
 }
 
-func TestLogHolder_StableEntries(t *testing.T) {
+func TestLogHolder_StableTo(t *testing.T) {
 	prevEntries := []raftpd.Entry{makeEntry(1, 1), makeEntry(2, 2), makeEntry(3, 3)}
 	tests := []struct {
-		stable uint64
-		wants  []raftpd.Entry
+		index, term uint64
+		ok          bool
+		stable      uint64
 	}{
-		{3, []raftpd.Entry{}},
-		{2, []raftpd.Entry{makeEntry(3, 3)}},
-		{1, []raftpd.Entry{makeEntry(2, 2), makeEntry(3, 3)}},
+		{2, 2, true, 2},
+		{3, 3, true, 3},
+		/* already stabled */
+		{1, 1, false, 1},
+		/* term mismatch, entry has been truncated */
+		{2, 1, false, 1},
+		/* out of range */
+		{4, 3, false, 1},
 	}
 
 	for i, test := range tests {
 		e := RebuildLogHolder(1, prevEntries)
-		e.lastStabled = test.stable
-		ents := e.StableEntries()
-		compareEntries(t, i, ents, test.wants)
+		e.lastStabled = 1
+		if ok := e.StableTo(test.index, test.term); ok != test.ok {
+			t.Fatalf("#%d: ok want: %v, get: %v", i, test.ok, ok)
+		}
+		if e.LastStabled() != test.stable {
+			t.Fatalf("#%d: stable want: %d, get: %d", i, test.stable, e.LastStabled())
+		}
 	}
 }
 
@@ -16,6 +16,10 @@ type Node struct {
 	// node id
 	ID uint64
 
+	// Learner is true if node is a learner, learner receives entries
+	// from leader, but it doesn't vote and isn't counted in quorum.
+	Learner bool
+
 	// detected status
 	Vote VoteState
 
@@ -47,6 +51,21 @@ type Node struct {
 	// is reported to be failed.
 	pendingSnapshot uint64
 
+	// snapshotOffset is used in nodeStateSnapshot, snapshot is sent in chunks,
+	// and it is the offset of pending snapshot which node has acked.
+	snapshotOffset uint64
+
+	// snapshotElapsed is used in nodeStateSnapshot, it is the time elapsed
+	// since last chunk acked, and used to detect failed snapshot transfer.
+	snapshotElapsed int
+
+	// snapshotRequested is true if application has been asked to build
+	// snapshot for this node, because entries it needs have been compacted.
+	// requestElapsed is the time elapsed since request, it is used to
+	// request again if application hasn't built snapshot in time.
+	snapshotRequested bool
+	requestElapsed    int
+
 	// inflights is a sliding window for the inflight messages.
 	// When inflights is full, no more message should be sent.
 	// When a leader sends out a message, the index of the last
@@ -55,6 +74,12 @@ type Node struct {
 	// When a leader receives a reply, the previous inflights should
 	// be freed by calling inflights.freeTo.
 	ins inFlights
+
+	// recentActive is true if leader has received any response from this
+	// node since it became leader, and inactiveElapsed is the time elapsed
+	// since last response. They are used to report whether node is active.
+	recentActive    bool
+	inactiveElapsed int
 }
 
 // MakeNode create instance for remote peer.
@@ -75,6 +100,13 @@ func MakeNode(belong, id, nextIdx uint64) *Node {
 	return node
 }
 
+// MakeLearner create instance for remote learner.
+func MakeLearner(belong, id, nextIdx uint64) *Node {
+	node := MakeNode(belong, id, nextIdx)
+	node.Learner = true
+	return node
+}
+
 // HandleUnreachable trigger unreachable event.
 func (n *Node) HandleUnreachable() {
 	switch n.state {
@@ -105,11 +137,55 @@ func (n *Node) HandleSnapshot(reject bool, index uint64, hintIndex uint64) {
 			n.NextIdx = n.Matched + 1
 			n.becomeProbe()
 		} else {
-			log.Panicf("unreachable")
+			// remote rejects snapshot, try again later.
+			n.NextIdx = n.pendingSnapshot
+			n.becomeProbe()
 		}
 	}
 }
 
+// HandleSnapshotChunk trigger receive snapshot chunk response event, it returns
+// true if response belongs to pending snapshot, and chunk begins at offset should
+// be sent next.
+func (n *Node) HandleSnapshotChunk(index uint64, offset uint64) bool {
+	if n.state != nodeStateSnapshot || index != n.pendingSnapshot {
+		/* ignore */
+		return false
+	}
+
+	n.snapshotOffset = offset
+	n.snapshotElapsed = 0
+	return true
+}
+
+// ReportSnapshot trigger snapshot sending result reported by application.
+// If success, node will probe from the entry after snapshot, otherwise
+// it probes from snapshot index, and snapshot will be resent if needed.
+func (n *Node) ReportSnapshot(success bool) {
+	if n.state != nodeStateSnapshot {
+		/* ignore */
+		return
+	}
+
+	if success {
+		n.NextIdx = utils.MaxUint64(n.Matched+1, n.pendingSnapshot+1)
+	} else {
+		n.NextIdx = n.pendingSnapshot
+	}
+	n.becomeProbe()
+}
+
+// SnapshotTimeout test whether node is in nodeStateSnapshot, and
+// no chunk has been acked within timeout.
+func (n *Node) SnapshotTimeout(timeout int) bool {
+	return n.state == nodeStateSnapshot && n.snapshotElapsed >= timeout
+}
+
+// SnapshotOffset return the offset of pending snapshot which node has acked.
+func (n *Node) SnapshotOffset() uint64 {
+	return n.snapshotOffset
+}
+
 // HandleAppendEntries trigger append response event.
 func (n *Node) HandleAppendEntries(reject bool, index uint64, hintIdx uint64) bool {
 	switch n.state {
@@ -168,9 +244,57 @@ func (n *Node) SendSnapshot(idx uint64) {
 		n.belongID, n.ID, n.state, nodeStateSnapshot, idx)
 
 	n.pendingSnapshot = idx
+	n.snapshotOffset = 0
+	n.snapshotElapsed = 0
+	n.snapshotRequested = false
 	n.state = nodeStateSnapshot
 }
 
+// RequestSnapshot records that snapshot is requested for node, it returns
+// false if previous request is in progress and doesn't exceed timeout.
+func (n *Node) RequestSnapshot(timeout int) bool {
+	if n.snapshotRequested && n.requestElapsed < timeout {
+		return false
+	}
+	n.snapshotRequested = true
+	n.requestElapsed = 0
+	return true
+}
+
+// SnapshotRequested test whether snapshot is requested for node,
+// and hasn't been sent.
+func (n *Node) SnapshotRequested() bool {
+	return n.snapshotRequested
+}
+
+// MarkActive records that a response has been received from this node.
+func (n *Node) MarkActive() {
+	n.recentActive = true
+	n.inactiveElapsed = 0
+}
+
+// ResetActive forgets responses received before.
+func (n *Node) ResetActive() {
+	n.recentActive = false
+	n.inactiveElapsed = 0
+}
+
+// Elapse increases time elapsed since last response.
+func (n *Node) Elapse(millis int) {
+	n.inactiveElapsed += millis
+	if n.state == nodeStateSnapshot {
+		n.snapshotElapsed += millis
+	}
+	if n.snapshotRequested {
+		n.requestElapsed += millis
+	}
+}
+
+// IsActive test whether response has been received within timeout.
+func (n *Node) IsActive(timeout int) bool {
+	return n.recentActive && n.inactiveElapsed < timeout
+}
+
 // UpdateVoteState set vote by reject, if true vote
 // set to voteReject, otherwise set to voteGranted.
 func (n *Node) UpdateVoteState(reject bool) {
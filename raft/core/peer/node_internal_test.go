@@ -151,6 +151,77 @@ func TestNode_handleSnapshot(t *testing.T) {
 	}
 }
 
+func TestNode_handleSnapshot_reject(t *testing.T) {
+	node := Node{
+		state:           nodeStateSnapshot,
+		pendingSnapshot: 10,
+	}
+	node.HandleSnapshot(true, 10, 3)
+	if node.state != nodeStateProbe || node.NextIdx != 10 {
+		t.Fatalf("reject want probe from: %d, get: %v, %d",
+			10, node.state, node.NextIdx)
+	}
+}
+
+// snapshot:
+//		report snapshot
+//			success: => probe (n: max{m+1, p+1})
+//			failure or timeout: => probe (n: p)
+func TestNode_ReportSnapshot(t *testing.T) {
+	tests := []struct {
+		state    nodeState
+		matched  uint64
+		success  bool
+		wstate   nodeState
+		wnextIdx uint64
+	}{
+		{nodeStateSnapshot, 0, true, nodeStateProbe, 11},
+		{nodeStateSnapshot, 20, true, nodeStateProbe, 21},
+		{nodeStateSnapshot, 0, false, nodeStateProbe, 10},
+		/* ignore */
+		{nodeStateReplicate, 0, false, nodeStateReplicate, 5},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		node := Node{
+			state:           test.state,
+			Matched:         test.matched,
+			NextIdx:         5,
+			pendingSnapshot: 10,
+			paused:          true,
+		}
+		node.ReportSnapshot(test.success)
+		if node.state != test.wstate {
+			t.Fatalf("#%d state want: %v, get: %v", i, test.wstate, node.state)
+		}
+		if node.NextIdx != test.wnextIdx {
+			t.Fatalf("#%d next idx want: %d, get: %d", i, test.wnextIdx, node.NextIdx)
+		}
+		if node.state == nodeStateProbe && node.paused {
+			t.Fatalf("#%d should not be paused", i)
+		}
+	}
+}
+
+func TestNode_SnapshotTimeout(t *testing.T) {
+	node := Node{}
+	node.SendSnapshot(10)
+	node.Elapse(5)
+	if node.SnapshotTimeout(10) {
+		t.Fatalf("snapshot should not timeout")
+	}
+	node.HandleSnapshotChunk(10, 1024)
+	node.Elapse(5)
+	if node.SnapshotTimeout(10) {
+		t.Fatalf("ack should reset snapshot elapsed")
+	}
+	node.Elapse(5)
+	if !node.SnapshotTimeout(10) {
+		t.Fatalf("snapshot should timeout")
+	}
+}
+
 func TestNode_handleAppendEntries_probe(t *testing.T) {
 	tests := []struct {
 		nextIdx            uint64
@@ -227,3 +298,30 @@ func TestNode_handleAppendEntries_replicate(t *testing.T) {
 		}
 	}
 }
+
+func TestNode_RequestSnapshot(t *testing.T) {
+	node := MakeNode(1, 2, 10)
+	tests := []struct {
+		elapsed int
+		send    bool /* send snapshot before request */
+		request bool
+	}{
+		{0, false, true},
+		{5, false, false},
+		{5, false, true},
+		{0, true, true},
+	}
+
+	for i, test := range tests {
+		node.Elapse(test.elapsed)
+		if test.send {
+			node.SendSnapshot(10)
+			if node.SnapshotRequested() {
+				t.Fatalf("#%d: request should be reset after snapshot sent", i)
+			}
+		}
+		if request := node.RequestSnapshot(10); request != test.request {
+			t.Fatalf("#%d: request want: %v, get: %v", i, test.request, request)
+		}
+	}
+}
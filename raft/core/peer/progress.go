@@ -0,0 +1,49 @@
+package peer
+
+// Progress is the replication progress of node seen by leader.
+type Progress struct {
+	ID      uint64
+	Learner bool
+
+	Matched uint64
+	NextIdx uint64
+	// State is one of Probe, Replicate and Snapshot.
+	State string
+	// Paused is true if leader stops sending entries to node, because
+	// it is probing, in-flight window is full, or snapshot is sending.
+	Paused bool
+	// Inflight is the number of append requests not acked.
+	Inflight int
+
+	// PendingSnapshot and SnapshotOffset are the index and acked
+	// offset of snapshot sending, if State is Snapshot.
+	PendingSnapshot uint64
+	SnapshotOffset  uint64
+	// SnapshotRequested is true if leader is waiting for application
+	// to build snapshot for node.
+	SnapshotRequested bool
+
+	// RecentActive is true if node has responded within timeout.
+	RecentActive bool
+}
+
+// Progress return the replication progress of node, timeout
+// is used to test whether node is active recently.
+func (n *Node) Progress(timeout int) Progress {
+	progress := Progress{
+		ID:                n.ID,
+		Learner:           n.Learner,
+		Matched:           n.Matched,
+		NextIdx:           n.NextIdx,
+		State:             n.state.String(),
+		Paused:            n.IsPaused(),
+		Inflight:          int(n.ins.count),
+		SnapshotRequested: n.snapshotRequested,
+		RecentActive:      n.IsActive(timeout),
+	}
+	if n.state == nodeStateSnapshot {
+		progress.PendingSnapshot = n.pendingSnapshot
+		progress.SnapshotOffset = n.snapshotOffset
+	}
+	return progress
+}
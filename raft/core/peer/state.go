@@ -24,12 +24,16 @@ const (
 // 		send snapshot => snapshot (p: log.snapshot.meta.idx)
 //
 // snapshot:
+// 		receive snapshot chunk response (o: offset acked, send chunk from o)
 // 		receive snapshot response
 //			success: => replicate (m: p, n: p + 1) (should be probe, because
 // 						when receive response, leader may generate new snapshot)
 //			failed: => probe (m: 0, n: p), because core will become follower if recieve
 //					reject from follower, it mean that term is old.
 //		unreachable => probe (m: 0, n: p)
+//		report snapshot
+//			success: => probe (n: max{m+1, p+1})
+//			failure or timeout: => probe (n: p)
 //
 // replicate:
 // 		send log entries (size: {infs.left, log.lastIdx-n}, n: lastIndex send)
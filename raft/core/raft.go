@@ -12,6 +12,9 @@ type Raft interface {
 	ReadSoftState() SoftState
 	ReadHardState() raftpd.HardState
 	ReadConfState() raftpd.ConfState
+	// Status return a snapshot of raft status, including
+	// replication progress of other nodes on leader.
+	Status() Status
 
 	// Propose.
 	Read(context []byte) bool
@@ -24,14 +27,35 @@ type Raft interface {
 	Propose(bytes []byte) (uint64, uint64, bool)
 	ProposeConfChange(cc *raftpd.ConfChange) (uint64, uint64, bool)
 
+	// TransferLeader try to transfer leadership to transferee,
+	// only take effect when current role is leader.
+	TransferLeader(transferee uint64)
+
 	// Apply change.
 	ApplySnapshot(metadata *raftpd.SnapshotMetadata)
+	// Compact discard applied entries before index, and return
+	// metadata of the new first entry if any entry discarded.
+	Compact(index uint64) (raftpd.SnapshotMetadata, bool)
 	ApplyConfChange(cc *raftpd.ConfChange) raftpd.ConfState
 
+	// HasReady test whether Ready has anything to handle.
+	HasReady() bool
+	// Ready return entries should be saved, and messages should be sent
+	// after that. Entries are not stabled until Advance or StableTo called,
+	// so they could be saved asynchronously.
 	Ready() Ready
+	Advance(ready Ready)
+	StableTo(index, term uint64)
+	// AppliedTo notice that entries up to index have been applied,
+	// read states are returned by Ready after they could be served.
+	AppliedTo(index uint64)
 	ReadStatus() (uint64, bool)
 
 	Unreachable(peer uint64)
+
+	// ReportSnapshot report the result of snapshot sending to peer, so that
+	// leader could continue replication or resend snapshot.
+	ReportSnapshot(peer uint64, status SnapshotStatus)
 }
 
 // MakeRaft return a Raft interface.
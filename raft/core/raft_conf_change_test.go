@@ -1,9 +1,12 @@
 package core
 
 import (
+	"reflect"
 	"testing"
 
+	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
 )
 
 // TestRaft_RecoverPendingConfig tests that new leader recovers its
@@ -53,7 +56,7 @@ func TestRaft_RecoverDoublePendingConfig(t *testing.T) {
 func TestRaft_AddNode(t *testing.T) {
 	r := makeTestRaft(1, []uint64{1}, 10, 1, nil, nil)
 	r.pendingConf = true
-	r.addNode(2)
+	r.addNode(2, false)
 
 	if r.pendingConf {
 		t.Fatalf("pending conf want: false, get: true")
@@ -79,3 +82,247 @@ func TestRaft_RemoveNode(t *testing.T) {
 		t.Fatalf("node remove failed")
 	}
 }
+
+// TestRaft_AddLearner tests that addNode could add
+// learner, and learner isn't counted in quorum.
+func TestRaft_AddLearner(t *testing.T) {
+	r := makeTestRaft(1, []uint64{1}, 10, 1, nil, nil)
+	r.pendingConf = true
+	r.addNode(2, true)
+
+	if r.pendingConf {
+		t.Fatalf("pending conf want: false, get: true")
+	}
+
+	if len(r.nodes) != 1 || r.nodes[0].ID != 2 || !r.nodes[0].Learner {
+		t.Fatalf("learner add failed")
+	}
+
+	if !r.isSingleton() {
+		t.Fatalf("learner should not be counted in quorum")
+	}
+
+	cs := r.ReadConfState()
+	if len(cs.Nodes) != 1 || cs.Nodes[0] != 1 {
+		t.Fatalf("conf state nodes want: [1], get: %v", cs.Nodes)
+	}
+	if len(cs.Learners) != 1 || cs.Learners[0] != 2 {
+		t.Fatalf("conf state learners want: [2], get: %v", cs.Learners)
+	}
+}
+
+// TestRaft_PromoteLearner tests that promoteNode could
+// change learner to voter, include self.
+func TestRaft_PromoteLearner(t *testing.T) {
+	r := makeTestRaft(1, []uint64{1}, 10, 1, nil, nil)
+	r.addNode(2, true)
+	r.pendingConf = true
+	r.promoteNode(2)
+
+	if r.pendingConf {
+		t.Fatalf("pending conf want: false, get: true")
+	}
+
+	if r.nodes[0].Learner {
+		t.Fatalf("learner promote failed")
+	}
+
+	if len(r.voters) != 2 || r.voters[1] != 2 {
+		t.Fatalf("voters want: [1 2], get: %v", r.voters)
+	}
+
+	r.isLearner = true
+	r.voters = r.voters[1:]
+	r.promoteNode(1)
+	if r.isLearner || !r.promotable() {
+		t.Fatalf("self promote failed")
+	}
+}
+
+// TestRaft_LearnerReplication tests that leader replicates entries
+// to learner, but commits them without learner's response.
+func TestRaft_LearnerReplication(t *testing.T) {
+	a := makeTestRaft(1, []uint64{1}, 10, 1, nil, nil)
+	b := makeTestRaft(2, []uint64{1}, 10, 1, nil, nil)
+	a.addNode(2, true)
+	b.isLearner = true
+
+	n := makeNetwork(a, b)
+
+	a.becomeCandidate()
+	a.becomeLeader()
+	a.broadcastVictory()
+	stableAll(a)
+	a.broadcastAppend()
+
+	if a.log.CommitIndex() != 1 {
+		t.Fatalf("commit index want: %d, get: %d", 1, a.log.CommitIndex())
+	}
+
+	if !n.waitCommit(1) {
+		t.Fatal("failed to replicate to learner")
+	}
+	if a.nodes[0].Matched != 1 {
+		t.Fatalf("learner matched want: %d, get: %d", 1, a.nodes[0].Matched)
+	}
+	if b.log.LastIndex() != 1 {
+		t.Fatalf("learner last index want: %d, get: %d", 1, b.log.LastIndex())
+	}
+}
+
+// TestRaft_LearnerCannotCampaign tests that learner never campaigns.
+func TestRaft_LearnerCannotCampaign(t *testing.T) {
+	r := makeTestRaft(2, []uint64{1}, 10, 1, nil, nil)
+	r.addNode(1, false)
+	r.isLearner = true
+
+	for i := 0; i < 3*r.electionTick; i++ {
+		r.Periodic(1)
+	}
+
+	if r.state != RoleFollower {
+		t.Fatalf("learner state want: %v, get: %v", RoleFollower, r.state)
+	}
+	if len(r.messages) != 0 {
+		t.Fatalf("learner should not send any message, get: %d", len(r.messages))
+	}
+}
+
+// TestRaft_EnterJoint tests that enterJoint could update configuration
+// to C_old,new, and leader will propose leave joint automatically.
+func TestRaft_EnterJoint(t *testing.T) {
+	r := makeTestRaft(1, []uint64{1, 2, 3}, 10, 1, nil, nil)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.pendingConf = true
+	r.enterJoint([]uint64{4, 5}, []uint64{2, 3})
+
+	cs := r.ReadConfState()
+	if !reflect.DeepEqual(cs.Nodes, []uint64{1, 4, 5}) {
+		t.Fatalf("conf state nodes want: [1 4 5], get: %v", cs.Nodes)
+	}
+	if !reflect.DeepEqual(cs.OutgoingNodes, []uint64{1, 2, 3}) {
+		t.Fatalf("conf state outgoing want: [1 2 3], get: %v", cs.OutgoingNodes)
+	}
+	if len(r.nodes) != 4 {
+		t.Fatalf("nodes size want: %d, get: %d", 4, len(r.nodes))
+	}
+
+	// leave joint has been proposed.
+	if !r.pendingConf {
+		t.Fatalf("pending conf want: true, get: false")
+	}
+	last := r.log.Slice(r.log.LastIndex(), r.log.LastIndex()+1)[0]
+	if last.Type != raftpd.EntryConfChange {
+		t.Fatalf("last entry type want: %v, get: %v", raftpd.EntryConfChange, last.Type)
+	}
+	cc := raftpd.ConfChange{}
+	pd.MustUnmarshal(&cc, last.Data)
+	if cc.ChangeType != raftpd.ConfChangeLeaveJoint {
+		t.Fatalf("conf change type want: %v, get: %v",
+			raftpd.ConfChangeLeaveJoint, cc.ChangeType)
+	}
+
+	r.ApplyConfChange(&cc)
+	cs = r.ReadConfState()
+	if !reflect.DeepEqual(cs.Nodes, []uint64{1, 4, 5}) || len(cs.OutgoingNodes) != 0 {
+		t.Fatalf("conf state after leave joint: %v", cs)
+	}
+	if len(r.nodes) != 2 || r.getNodeByID(2) != nil || r.getNodeByID(3) != nil {
+		t.Fatalf("removed nodes should be dropped after leave joint")
+	}
+}
+
+// TestRaft_DoubleLeaveJoint tests that leave joint couldn't be proposed
+// while the one appended after entering joint isn't applied, otherwise
+// the next leader panics because of multiple uncommitted conf entries.
+func TestRaft_DoubleLeaveJoint(t *testing.T) {
+	r := makeTestRaft(1, []uint64{1, 2, 3}, 10, 1, nil, nil)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.pendingConf = true
+	r.enterJoint([]uint64{4, 5}, []uint64{2, 3})
+
+	cc := raftpd.ConfChange{ChangeType: raftpd.ConfChangeLeaveJoint}
+	if _, _, ok := r.ProposeConfChange(&cc); ok {
+		t.Fatalf("leave joint should be rejected while pending")
+	}
+	if num := r.numOfPendingConf(); num != 1 {
+		t.Fatalf("pending conf entries want: 1, get: %d", num)
+	}
+
+	// re-elected leader must not panic.
+	r.becomeFollower(r.term, conf.InvalidID)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	r.ApplyConfChange(&cc)
+	add := raftpd.ConfChange{ChangeType: raftpd.ConfChangeAddNode, NodeID: 6}
+	if _, _, ok := r.ProposeConfChange(&add); !ok {
+		t.Fatalf("conf change should be accepted after leave joint applied")
+	}
+}
+
+// TestRaft_JointCommit tests that commit requires majority
+// of both old and new configurations in joint consensus.
+func TestRaft_JointCommit(t *testing.T) {
+	r := makeTestRaft(1, []uint64{1, 2, 3}, 10, 1, nil, nil)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.enterJoint([]uint64{4, 5}, []uint64{2, 3})
+	stableAll(r)
+
+	idx := r.log.LastIndex()
+	tests := []struct {
+		matched []uint64
+		commit  bool
+	}{
+		{[]uint64{2, 3}, false},
+		{[]uint64{4, 5}, false},
+		{[]uint64{2, 4}, true},
+	}
+	for i, test := range tests {
+		for _, node := range r.nodes {
+			node.Matched = conf.InvalidIndex
+		}
+		for _, id := range test.matched {
+			r.getNodeByID(id).Matched = idx
+		}
+		r.poll(idx)
+		if (r.log.CommitIndex() == idx) != test.commit {
+			t.Fatalf("#%d commit want: %v, get commit index: %d", i, test.commit, r.log.CommitIndex())
+		}
+	}
+}
+
+// TestRaft_JointVote tests that candidate requires votes
+// from majority of both old and new configurations.
+func TestRaft_JointVote(t *testing.T) {
+	tests := []struct {
+		granted []uint64
+		rejects []uint64
+		state   StateRole
+	}{
+		{[]uint64{2, 3}, nil, RoleCandidate},
+		{[]uint64{2, 4}, nil, RoleLeader},
+		{nil, []uint64{4, 5}, RoleFollower},
+		{nil, []uint64{2, 3}, RoleFollower},
+		{[]uint64{2}, []uint64{4}, RoleCandidate},
+	}
+	for i, test := range tests {
+		r := makeTestRaft(1, []uint64{1, 2, 3}, 10, 1, nil, nil)
+		r.enterJoint([]uint64{4, 5}, []uint64{2, 3})
+		r.becomeCandidate()
+
+		for _, id := range test.granted {
+			r.Step(&raftpd.Message{From: id, To: 1, Term: r.term, MsgType: raftpd.MsgVoteResponse})
+		}
+		for _, id := range test.rejects {
+			r.Step(&raftpd.Message{From: id, To: 1, Term: r.term,
+				MsgType: raftpd.MsgVoteResponse, Reject: true})
+		}
+		if r.state != test.state {
+			t.Fatalf("#%d state want: %v, get: %v", i, test.state, r.state)
+		}
+	}
+}
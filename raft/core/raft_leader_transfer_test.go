@@ -0,0 +1,184 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/thinkermao/bior/raft/core/conf"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// TestRaft_LeaderTransferToUpToDateNode tests that leader could
+// transfer leadership to a node which has up-to-date log immediately.
+func TestRaft_LeaderTransferToUpToDateNode(t *testing.T) {
+	n := generate(3)
+	n.startElection(1)
+
+	// wait noop commit
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	lead := n.peer(1)
+	if lead.state != RoleLeader {
+		t.Fatal("1 not leader")
+	}
+
+	lead.TransferLeader(2)
+	n.transferMessages(1)
+	n.dispatchMessages()
+
+	if n.peer(2).state != RoleLeader {
+		t.Fatalf("after transfer, 2 state want: %v, get: %v",
+			RoleLeader, n.peer(2).state)
+	}
+	if lead.state != RoleFollower || lead.leaderID != 2 {
+		t.Fatalf("after transfer, 1 want follow 2, get: %v, leader: %d",
+			lead.state, lead.leaderID)
+	}
+	if lead.leadTransferee != conf.InvalidID {
+		t.Fatalf("lead transferee want: %d, get: %d",
+			conf.InvalidID, lead.leadTransferee)
+	}
+}
+
+// TestRaft_LeaderTransferToSlowFollower tests that leader will
+// catch transferee up before send timeout now to it.
+func TestRaft_LeaderTransferToSlowFollower(t *testing.T) {
+	n := generate(3)
+	n.startElection(1)
+
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	slow := n.peer(3)
+	n.down(3)
+
+	var idx uint64
+	for i := 0; i < 5; i++ {
+		idx, _ = n.propose(1, []byte("somedata"))
+	}
+	if !n.waitCommit(idx) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	n.add(slow)
+	lead := n.peer(1)
+	lead.TransferLeader(3)
+	n.transferMessages(1)
+	n.dispatchMessages()
+
+	if slow.state != RoleLeader {
+		t.Fatalf("after transfer, 3 state want: %v, get: %v",
+			RoleLeader, slow.state)
+	}
+	if slow.log.LastIndex() <= idx {
+		t.Fatalf("3 last index want great than: %d, get: %d",
+			idx, slow.log.LastIndex())
+	}
+}
+
+// TestRaft_LeaderTransferIgnoreProposal tests that leader drops
+// proposals during transfer, and accepts them again after the
+// transfer is aborted by election timeout.
+func TestRaft_LeaderTransferIgnoreProposal(t *testing.T) {
+	n := generate(3)
+	n.startElection(1)
+
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	n.down(3)
+	lead := n.peer(1)
+	lead.TransferLeader(3)
+	lead.messages = lead.messages[:0]
+
+	if lead.leadTransferee != 3 {
+		t.Fatalf("lead transferee want: %d, get: %d", 3, lead.leadTransferee)
+	}
+
+	if _, _, ok := lead.Propose([]byte("somedata")); ok {
+		t.Fatal("propose should be dropped during leader transfer")
+	}
+
+	for i := 0; i < lead.electionTick; i++ {
+		lead.Periodic(1)
+	}
+
+	if lead.state != RoleLeader {
+		t.Fatalf("state want: %v, get: %v", RoleLeader, lead.state)
+	}
+	if lead.leadTransferee != conf.InvalidID {
+		t.Fatalf("transfer should be aborted after election timeout")
+	}
+	if _, _, ok := lead.Propose([]byte("somedata")); !ok {
+		t.Fatal("propose should be accepted after leader transfer aborted")
+	}
+}
+
+// TestRaft_LeaderTransferIgnoreInvalidTarget tests that leader
+// ignores transfer to itself or unknown nodes.
+func TestRaft_LeaderTransferIgnoreInvalidTarget(t *testing.T) {
+	n := generate(3)
+	n.startElection(1)
+
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	tests := []uint64{1, 4}
+	lead := n.peer(1)
+	for i, test := range tests {
+		lead.TransferLeader(test)
+		if lead.leadTransferee != conf.InvalidID {
+			t.Fatalf("#%d lead transferee want: %d, get: %d",
+				i, conf.InvalidID, lead.leadTransferee)
+		}
+	}
+}
+
+// TestRaft_LeaderTransferResendTimeoutNow tests that leader sends timeout
+// now again on responses from caught up transferee if the first is lost.
+func TestRaft_LeaderTransferResendTimeoutNow(t *testing.T) {
+	tests := []struct {
+		trigger func(lead *RawNode)
+	}{
+		// append response of heartbeat broadcast.
+		{func(lead *RawNode) { lead.Periodic(lead.heartbeatTick) }},
+		// heartbeat response of read index.
+		{func(lead *RawNode) { lead.Read([]byte("ctx")) }},
+	}
+
+	for i, test := range tests {
+		n := generate(3)
+		n.startElection(1)
+
+		if !n.waitCommit(1) {
+			t.Fatalf("#%d failed to acheive agreement", i)
+		}
+
+		lead := n.peer(1)
+		n.ignore(raftpd.MsgTimeoutNowRequest)
+		lead.TransferLeader(2)
+		n.transferMessages(1)
+		n.dispatchMessages()
+		n.recover()
+
+		if n.peer(2).state == RoleLeader {
+			t.Fatalf("#%d 2 should not be leader before timeout now received", i)
+		}
+		if lead.leadTransferee != 2 {
+			t.Fatalf("#%d lead transferee want: %d, get: %d", i, 2, lead.leadTransferee)
+		}
+
+		test.trigger(lead)
+		n.transferMessages(1)
+		n.dispatchMessages()
+
+		if n.peer(2).state != RoleLeader {
+			t.Fatalf("#%d after transfer, 2 state want: %v, get: %v",
+				i, RoleLeader, n.peer(2).state)
+		}
+	}
+}
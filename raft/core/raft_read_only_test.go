@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/proto"
 )
 
@@ -83,7 +84,7 @@ func TestRaft_ReadOnlyForNewLeader(t *testing.T) {
 			{Index: 1, Term: 1, Type: raftpd.EntryNormal},
 			{Index: 2, Term: 1, Type: raftpd.EntryNormal},
 		})
-		peer.log.StableEntries()
+		stableAll(peer)
 		peer.log.CommitTo(c.committed)
 		if c.compactedIdx != 0 {
 			peer.log.CompactTo(c.compactedIdx, 1)
@@ -136,3 +137,88 @@ func TestRaft_ReadOnlyForNewLeader(t *testing.T) {
 		t.Fatalf("read state ctx not equals")
 	}
 }
+
+// TestRaft_LeaseReadOnly ensures that leader answers read only request
+// directly when it in lease, otherwise falls back to read index, and
+// lease is counted since heartbeats sent rather than responses received.
+func TestRaft_LeaseReadOnly(t *testing.T) {
+	nodes := []uint64{1, 2, 3}
+	opt := readOnlyOption(conf.ReadOnlyLeaseBased)
+	a := makeTestRaft(1, nodes, 10, 1, nil, nil, opt)
+	b := makeTestRaft(2, nodes, 10, 1, nil, nil, opt)
+	c := makeTestRaft(3, nodes, 10, 1, nil, nil, opt)
+	n := makeNetwork(a, b, c)
+
+	n.startElection(1)
+
+	// wait noop commit
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+
+	if a.state != RoleLeader {
+		t.Fatal("a not leader")
+	}
+
+	sentHeartbeat := func() bool {
+		for _, msg := range a.messages {
+			if msg.MsgType == raftpd.MsgHeartbeatRequest {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		elapsed   int
+		ctx       []byte
+		heartbeat bool
+	}{
+		// no lease before any heartbeats responded.
+		{0, []byte("ctx1"), true},
+		// in lease, answer it directly without heartbeat.
+		{0, []byte("ctx2"), false},
+		{a.leaseTimeout() - 1, []byte("ctx3"), false},
+		// lease expired, fall back to read index.
+		{1, []byte("ctx4"), true},
+	}
+
+	for i, test := range tests {
+		a.Periodic(test.elapsed)
+		a.messages = a.messages[:0]
+		a.readStates = a.readStates[:0]
+
+		a.Read(test.ctx)
+		if sentHeartbeat() != test.heartbeat {
+			t.Fatalf("#%d send heartbeat want: %v, get: %v", i, test.heartbeat, !test.heartbeat)
+		}
+		n.transferMessages(1)
+		n.dispatchMessages()
+
+		if len(a.readStates) != 1 || !bytes.Equal(a.readStates[0].RequestCtx, test.ctx) {
+			t.Fatalf("#%d read states want: [%s], get: %v", i, test.ctx, a.readStates)
+		}
+	}
+
+	// redirect from follower.
+	n.readIndex(2, []byte("ctx5"))
+	if len(b.readStates) != 1 || b.readStates[0].Index != 1 {
+		t.Fatalf("read states want: [1], get: %v", b.readStates)
+	}
+
+	// responses delayed, lease begins at the time heartbeats sent.
+	a.Periodic(a.electionTick)
+	a.messages = a.messages[:0]
+	a.Read([]byte("ctx6"))
+	a.Periodic(a.leaseTimeout() - 1)
+	n.transferMessages(1)
+	n.dispatchMessages()
+	a.readStates = a.readStates[:0]
+	a.messages = a.messages[:0]
+
+	a.Periodic(1)
+	a.Read([]byte("ctx7"))
+	if !sentHeartbeat() {
+		t.Fatalf("leader out of lease should send heartbeat")
+	}
+}
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+type testSnapshotApp struct {
+	snapshot *raftpd.Snapshot
+	applied  *raftpd.Snapshot
+}
+
+func (app *testSnapshotApp) ApplySnapshot(snapshot *raftpd.Snapshot) {
+	app.applied = snapshot
+}
+
+func (app *testSnapshotApp) ReadSnapshot() *raftpd.Snapshot {
+	return app.snapshot
+}
+
+// deliver step all messages of `from` to `to`, and returns them.
+func deliver(from, to *RawNode) []raftpd.Message {
+	msgs := from.messages
+	from.messages = nil
+	for i := 0; i < len(msgs); i++ {
+		to.Step(&msgs[i])
+	}
+	return msgs
+}
+
+func makeSnapshotTest(size int) (*RawNode, *RawNode, *testSnapshotApp) {
+	data := make([]byte, size)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	leaderApp := &testSnapshotApp{
+		snapshot: &raftpd.Snapshot{
+			Metadata: raftpd.SnapshotMetadata{Index: 11, Term: 1},
+			Data:     data,
+		},
+	}
+	followerApp := &testSnapshotApp{}
+
+	r1 := makeTestRaft(1, []uint64{1, 2}, 10, 1, nil, leaderApp)
+	r2 := makeTestRaft(2, []uint64{1, 2}, 10, 1, nil, followerApp)
+	r1.becomeCandidate()
+	r1.becomeLeader()
+	return r1, r2, followerApp
+}
+
+// TestRaft_SnapshotChunks tests that snapshot is sent in chunks,
+// and the next chunk is sent after previous one acked.
+func TestRaft_SnapshotChunks(t *testing.T) {
+	r1, r2, app := makeSnapshotTest(2500)
+	r1.sendSnapshot(r1.getNodeByID(2))
+
+	var offsets []uint64
+	for len(r1.messages) > 0 {
+		msgs := deliver(r1, r2)
+		for _, msg := range msgs {
+			if msg.MsgType == raftpd.MsgSnapshotRequest {
+				offsets = append(offsets, msg.Offset)
+			}
+		}
+		deliver(r2, r1)
+	}
+
+	wantOffsets := []uint64{0, 1024, 2048}
+	if len(offsets) != len(wantOffsets) {
+		t.Fatalf("chunks want: %v, get: %v", wantOffsets, offsets)
+	}
+	for i := 0; i < len(offsets); i++ {
+		if offsets[i] != wantOffsets[i] {
+			t.Fatalf("chunks want: %v, get: %v", wantOffsets, offsets)
+		}
+	}
+
+	if app.applied == nil || !bytes.Equal(app.applied.Data, r1.application.ReadSnapshot().Data) {
+		t.Fatalf("snapshot data is not restored")
+	}
+	if r2.log.LastIndex() != 11 {
+		t.Fatalf("follower last index want: %d, get: %d", 11, r2.log.LastIndex())
+	}
+	if node := r1.getNodeByID(2); node.Matched != 11 || node.IsPaused() {
+		t.Fatalf("node want matched: %d and not paused, get: %d, %v",
+			11, node.Matched, node.IsPaused())
+	}
+	if len(r1.snapshotSenders) != 0 {
+		t.Fatalf("snapshot sender should be closed")
+	}
+}
+
+// TestRaft_SnapshotResume tests that a new transfer of the same snapshot
+// resumes from the offset follower has received.
+func TestRaft_SnapshotResume(t *testing.T) {
+	r1, r2, app := makeSnapshotTest(2500)
+	node := r1.getNodeByID(2)
+	r1.sendSnapshot(node)
+
+	// receive first chunk, then the ack is lost.
+	deliver(r1, r2)
+	r2.messages = nil
+	r1.Unreachable(2)
+	r1.messages = nil
+	if r2.snapshotReceiver == nil || r2.snapshotReceiver.offset != 1024 {
+		t.Fatalf("follower should keep received chunks")
+	}
+
+	r1.sendSnapshot(node)
+	var offsets []uint64
+	for len(r1.messages) > 0 {
+		msgs := deliver(r1, r2)
+		for _, msg := range msgs {
+			if msg.MsgType == raftpd.MsgSnapshotRequest {
+				offsets = append(offsets, msg.Offset)
+			}
+		}
+		deliver(r2, r1)
+	}
+
+	// first chunk is ignored by follower, and it
+	// replies the offset to resume from.
+	wantOffsets := []uint64{0, 1024, 2048}
+	if len(offsets) != len(wantOffsets) {
+		t.Fatalf("chunks want: %v, get: %v", wantOffsets, offsets)
+	}
+	for i := 0; i < len(offsets); i++ {
+		if offsets[i] != wantOffsets[i] {
+			t.Fatalf("chunks want: %v, get: %v", wantOffsets, offsets)
+		}
+	}
+	if app.applied == nil || !bytes.Equal(app.applied.Data, r1.application.ReadSnapshot().Data) {
+		t.Fatalf("snapshot data is not restored")
+	}
+	if node.Matched != 11 {
+		t.Fatalf("node matched want: %d, get: %d", 11, node.Matched)
+	}
+}
+
+// TestRaft_SnapshotSurviveHeartbeat tests that snapshot
+// transfer isn't interrupted by heartbeat of leader.
+func TestRaft_SnapshotSurviveHeartbeat(t *testing.T) {
+	r1, r2, app := makeSnapshotTest(2500)
+	r1.sendSnapshot(r1.getNodeByID(2))
+
+	for len(r1.messages) > 0 && app.applied == nil {
+		deliver(r1, r2)
+		deliver(r2, r1)
+		r1.Periodic(r1.heartbeatTick)
+	}
+
+	if app.applied == nil {
+		t.Fatalf("snapshot is not restored")
+	}
+}
+
+// TestRaft_SnapshotConfState tests that follower replaces its
+// configuration by the one in snapshot, unless snapshot has none.
+func TestRaft_SnapshotConfState(t *testing.T) {
+	tests := []struct {
+		confState raftpd.ConfState
+		want      raftpd.ConfState
+	}{
+		{raftpd.ConfState{}, raftpd.ConfState{Nodes: []uint64{1, 2}, Learners: []uint64{}}},
+		{
+			raftpd.ConfState{Nodes: []uint64{1, 2, 3}, Learners: []uint64{4}},
+			raftpd.ConfState{Nodes: []uint64{1, 2, 3}, Learners: []uint64{4}},
+		},
+	}
+
+	for i, test := range tests {
+		r1, r2, app := makeSnapshotTest(100)
+		r1.application.ReadSnapshot().Metadata.ConfState = test.confState
+		r1.sendSnapshot(r1.getNodeByID(2))
+		for len(r1.messages) > 0 {
+			deliver(r1, r2)
+			deliver(r2, r1)
+		}
+
+		if app.applied == nil {
+			t.Fatalf("#%d snapshot is not restored", i)
+		}
+		state := r2.ReadConfState()
+		state.OutgoingNodes = nil
+		if !reflect.DeepEqual(state, test.want) {
+			t.Fatalf("#%d conf state want: %v, get: %v", i, test.want, state)
+		}
+		if len(r2.nodes)+1 != len(test.want.Nodes)+len(test.want.Learners) {
+			t.Fatalf("#%d nodes want: %d, get: %d", i,
+				len(test.want.Nodes)+len(test.want.Learners)-1, len(r2.nodes))
+		}
+	}
+}
+
+// TestRaft_SnapshotReport tests that leader stops sending snapshot
+// chunks after failure reported or timeout.
+func TestRaft_SnapshotReport(t *testing.T) {
+	tests := []struct {
+		report func(r *RawNode)
+		next   uint64
+	}{
+		{func(r *RawNode) { r.ReportSnapshot(2, SnapshotFailure) }, 11},
+		{func(r *RawNode) { r.ReportSnapshot(2, SnapshotFinish) }, 12},
+		{func(r *RawNode) { r.Periodic(r.electionTick) }, 11},
+	}
+
+	for i, test := range tests {
+		r1, r2, _ := makeSnapshotTest(2500)
+		node := r1.getNodeByID(2)
+		r1.sendSnapshot(node)
+		deliver(r1, r2)
+
+		test.report(r1)
+		if node.NextIdx != test.next {
+			t.Fatalf("#%d node want probe from: %d, get: %d",
+				i, test.next, node.NextIdx)
+		}
+		if len(r1.snapshotSenders) != 0 {
+			t.Fatalf("#%d snapshot sender should be closed", i)
+		}
+
+		// ack of aborted transfer is ignored.
+		r1.messages = nil
+		deliver(r2, r1)
+		for _, msg := range r1.messages {
+			if msg.MsgType == raftpd.MsgSnapshotRequest {
+				t.Fatalf("#%d unexpected snapshot chunk: %v", i, msg)
+			}
+		}
+	}
+}
+
+type requestSnapshotApp struct {
+	testSnapshotApp
+	requests []uint64
+}
+
+func (app *requestSnapshotApp) RequestSnapshot(nodeID uint64) {
+	app.requests = append(app.requests, nodeID)
+}
+
+// TestRaft_RequestSnapshot tests that application is asked to build
+// snapshot if no one is available, and asked again after timeout.
+func TestRaft_RequestSnapshot(t *testing.T) {
+	app := &requestSnapshotApp{}
+	r1 := makeTestRaft(1, []uint64{1, 2}, 10, 1, nil, app)
+	r1.becomeCandidate()
+	r1.becomeLeader()
+	node := r1.getNodeByID(2)
+
+	tests := []struct {
+		elapsed  int
+		snapshot bool
+		requests int
+	}{
+		{0, false, 1},
+		/* request in progress */
+		{0, false, 1},
+		{r1.electionTick - 1, false, 1},
+		/* timeout */
+		{1, false, 2},
+		{0, true, 2},
+	}
+
+	for i, test := range tests {
+		node.Elapse(test.elapsed)
+		if test.snapshot {
+			app.snapshot = &raftpd.Snapshot{
+				Metadata: raftpd.SnapshotMetadata{Index: 11, Term: 1},
+			}
+		}
+		r1.sendSnapshot(node)
+		if len(app.requests) != test.requests {
+			t.Fatalf("#%d: requests want: %d, get: %v", i, test.requests, app.requests)
+		}
+		if node.SnapshotRequested() == test.snapshot {
+			t.Fatalf("#%d: requested want: %v", i, !test.snapshot)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"io"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/core/read"
@@ -13,6 +15,34 @@ type NodeApplication interface {
 	ReadSnapshot() *raftpd.Snapshot
 }
 
+// SnapshotStreamer could be implemented by NodeApplication to transfer
+// snapshot data by stream, instead of holding whole snapshot in memory.
+// If it is implemented, ApplySnapshot & ReadSnapshot of NodeApplication
+// are not used by raft.
+type SnapshotStreamer interface {
+	// OpenSnapshot return metadata and data reader of latest snapshot
+	// has been persisted, reader is nil if snapshot is building at now.
+	// Reader implements io.Seeker is preferred, so transfer could resume
+	// from any offset.
+	OpenSnapshot() (raftpd.SnapshotMetadata, io.ReadCloser)
+
+	// CreateSnapshot return writer which snapshot data received from
+	// leader is written to. Writer will be closed after all data written,
+	// then RestoreSnapshot is called, or transfer is aborted.
+	CreateSnapshot(metadata *raftpd.SnapshotMetadata) (io.WriteCloser, error)
+
+	// RestoreSnapshot restore state machine from snapshot data written.
+	RestoreSnapshot(metadata *raftpd.SnapshotMetadata)
+}
+
+// SnapshotRequester could be implemented by NodeApplication to build
+// snapshot on demand. RequestSnapshot is called when entries needed
+// by node have been compacted, but no snapshot is available. It is
+// called again if snapshot is still unavailable after election timeout.
+type SnapshotRequester interface {
+	RequestSnapshot(nodeID uint64)
+}
+
 type Ready struct {
 	// The current volatile state of a Node.
 	// SoftState will be nil if there is no update.
@@ -26,7 +56,8 @@ type Ready struct {
 
 	// read_states states can be used for node to serve linearizable read requests locally
 	// when its applied index is greater than the index in ReadState.
-	// Note that the read_state will be returned when raft receives MsgReadIndex.
+	// Note that the read_state will be returned after raft receives MsgReadIndex,
+	// and applied index reported by AppliedTo has reached its index.
 	// The returned is only valid for the request that requested to read.
 	ReadStates []read.ReadState
 
@@ -44,8 +75,9 @@ type Ready struct {
 
 	// Messages specifies outbound messages to be sent AFTER Entries are
 	// committed to stable storage.
-	// If it contains a MsgSnap pd, the application MUST report back to raft
-	// when the snapshot has been received or has failed by calling ReportSnapshot.
+	// If it contains a MsgSnapshotRequest, the application MUST report back to
+	// raft when sending has failed, or the last chunk (Done is true) has been
+	// received, by calling ReportSnapshot.
 	Messages []raftpd.Message
 }
 
@@ -54,11 +86,19 @@ type RawNode struct {
 	prevHS raftpd.HardState
 	prevSS SoftState
 
+	// last entry handed out by Ready, but not stabled.
+	readyIndex uint64
+	readyTerm  uint64
+
+	// index of last entry applied by application.
+	applied uint64
+
 	readStates    []read.ReadState
 	commitEntries []raftpd.Entry
 	messages      []raftpd.Message
 
 	application NodeApplication
+	streamer    SnapshotStreamer
 }
 
 func MakeRawNode(config *conf.Config, app NodeApplication) *RawNode {
@@ -66,6 +106,11 @@ func MakeRawNode(config *conf.Config, app NodeApplication) *RawNode {
 
 	node.core = makeCore(config, node)
 	node.application = app
+	if streamer, ok := app.(SnapshotStreamer); ok {
+		node.streamer = streamer
+	} else {
+		node.streamer = &bytesStreamer{application: app}
+	}
 	node.prevSS = node.core.ReadSoftState()
 	node.prevHS = node.core.ReadHardState()
 	return node
@@ -81,11 +126,29 @@ func (node *RawNode) Unreachable(peer uint64) {
 	node.Step(&msg)
 }
 
+// HasReady test whether there is any update should be handled by Ready.
+func (node *RawNode) HasReady() bool {
+	if node.core.ReadSoftState() != node.prevSS {
+		return true
+	}
+	if node.core.ReadHardState() != node.prevHS {
+		return true
+	}
+	if len(node.messages) > 0 || len(node.commitEntries) > 0 {
+		return true
+	}
+	if len(node.readStates) > 0 && node.readStates[0].Index <= node.applied {
+		return true
+	}
+	return node.unstableFrom() < node.core.log.LastIndex()
+}
+
 func (node *RawNode) Ready() Ready {
 	ready := Ready{}
 
 	ss := node.core.ReadSoftState()
 	ready.SS = &ss
+	node.prevSS = ss
 
 	hs := node.core.ReadHardState()
 	if hs != node.prevHS {
@@ -93,7 +156,12 @@ func (node *RawNode) Ready() Ready {
 		node.prevHS = hs
 	}
 
-	ready.Entries = node.core.log.StableEntries()
+	from, last := node.unstableFrom(), node.core.log.LastIndex()
+	ready.Entries = node.core.log.Slice(from+1, last+1)
+	if len(ready.Entries) > 0 {
+		node.readyIndex = last
+		node.readyTerm = node.core.log.Term(last)
+	}
 	ready.CommitEntries = node.commitEntries
 	ready.Messages = node.messages
 	ready.ReadStates = node.drainReadState()
@@ -108,6 +176,42 @@ func (node *RawNode) Ready() Ready {
 	return ready
 }
 
+// Advance notice that entries of ready have been saved to stable
+// storage, ready must be returned by last call of Ready.
+func (node *RawNode) Advance(ready Ready) {
+	if len(ready.Entries) > 0 {
+		last := &ready.Entries[len(ready.Entries)-1]
+		node.core.StableTo(last.Index, last.Term)
+	}
+}
+
+// AppliedTo notice that entries up to index have been applied
+// to state machine, read states wait for it will be ready.
+func (node *RawNode) AppliedTo(index uint64) {
+	if node.applied < index {
+		node.applied = index
+	}
+}
+
+// unstableFrom return the index after which entries haven't been
+// handed out by Ready. Entries handed out but truncated by new
+// leader should be handed out again.
+func (node *RawNode) unstableFrom() uint64 {
+	stabled := node.core.log.LastStabled()
+	if node.readyIndex <= stabled || node.readyIndex > node.core.log.LastIndex() ||
+		node.core.log.Term(node.readyIndex) != node.readyTerm {
+		return stabled
+	}
+	return node.readyIndex
+}
+
+// Status return a snapshot of raft status.
+func (node *RawNode) Status() Status {
+	status := node.core.Status()
+	status.Applied = node.applied
+	return status
+}
+
 func (node *RawNode) ReadStatus() (uint64, bool) {
 	ss := node.core.ReadSoftState()
 	hs := node.core.ReadHardState()
@@ -127,26 +231,30 @@ func (node *RawNode) applyEntry(entry *raftpd.Entry) {
 	node.commitEntries = append(node.commitEntries, *entry)
 }
 
-func (node *RawNode) applySnapshot(snapshot *raftpd.Snapshot) {
-	node.application.ApplySnapshot(snapshot)
+func (node *RawNode) openSnapshot() (raftpd.SnapshotMetadata, io.ReadCloser) {
+	return node.streamer.OpenSnapshot()
+}
+
+func (node *RawNode) createSnapshot(metadata *raftpd.SnapshotMetadata) (io.WriteCloser, error) {
+	return node.streamer.CreateSnapshot(metadata)
+}
+
+func (node *RawNode) requestSnapshot(nodeID uint64) {
+	if requester, ok := node.application.(SnapshotRequester); ok {
+		requester.RequestSnapshot(nodeID)
+	}
 }
 
-func (node *RawNode) readSnapshot() *raftpd.Snapshot {
-	return node.application.ReadSnapshot()
+func (node *RawNode) restoreSnapshot(metadata *raftpd.SnapshotMetadata) {
+	node.streamer.RestoreSnapshot(metadata)
+	node.AppliedTo(metadata.Index)
 }
 
 func (node *RawNode) drainReadState() []read.ReadState {
 	var readStates []read.ReadState
-	lastApplied := node.prevHS.Commit
-	if len(node.commitEntries) > 0 {
-		waitCommitIdx := node.commitEntries[len(node.commitEntries)-1].Index
-		if lastApplied < waitCommitIdx {
-			lastApplied = waitCommitIdx
-		}
-	}
 	i := 0
 	for ; i < len(node.readStates); i++ {
-		if node.readStates[i].Index > lastApplied {
+		if node.readStates[i].Index > node.applied {
 			break
 		}
 	}
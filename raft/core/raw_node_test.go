@@ -0,0 +1,141 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestRawNode_HasReady(t *testing.T) {
+	node := makeTestRaft(1, []uint64{1, 2}, 10, 1, nil, nil)
+	node.Ready()
+	if node.HasReady() {
+		t.Fatalf("there is nothing to handle after ready")
+	}
+
+	/* election timeout, pre vote is sent */
+	node.Periodic(20)
+	if !node.HasReady() {
+		t.Fatalf("messages should be handled by ready")
+	}
+	ready := node.Ready()
+	if len(ready.Messages) == 0 {
+		t.Fatalf("want pre vote messages, get nothing")
+	}
+	if node.HasReady() {
+		t.Fatalf("there is nothing to handle after ready")
+	}
+
+	node.Periodic(1)
+	if node.HasReady() {
+		t.Fatalf("tick without any change should not make ready")
+	}
+}
+
+// TestRawNode_Advance tests that entries are committed only after
+// stabled by Advance, and entries handed out are not handed out again.
+func TestRawNode_Advance(t *testing.T) {
+	node := makeTestRaft(1, []uint64{1}, 10, 1, nil, nil)
+	node.Periodic(20)
+	if !node.state.IsLeader() {
+		t.Fatalf("singleton should become leader, get: %v", node.state)
+	}
+	ready := node.Ready()
+	node.Advance(ready)
+	node.Ready()
+
+	index, _, _ := node.Propose([]byte("data"))
+	ready = node.Ready()
+	if len(ready.Entries) != 1 || ready.Entries[0].Index != index {
+		t.Fatalf("want entry %d to save, get: %v", index, ready.Entries)
+	}
+	if node.log.CommitIndex() >= index {
+		t.Fatalf("entry %d should not be committed before stabled", index)
+	}
+	if again := node.Ready(); len(again.Entries) != 0 {
+		t.Fatalf("entries handed out should not be saved again, get: %v", again.Entries)
+	}
+
+	node.Advance(ready)
+	if node.log.CommitIndex() != index {
+		t.Fatalf("commit index want: %d, get: %d", index, node.log.CommitIndex())
+	}
+	ready = node.Ready()
+	if len(ready.CommitEntries) != 1 || ready.CommitEntries[0].Index != index {
+		t.Fatalf("want entry %d to apply, get: %v", index, ready.CommitEntries)
+	}
+}
+
+// TestRawNode_LeaderStableInParallel tests that leader could replicate
+// entries before they are stabled, but counts itself only after that.
+func TestRawNode_LeaderStableInParallel(t *testing.T) {
+	r1 := makeTestRaft(1, []uint64{1, 2, 3}, 10, 1, nil, nil)
+	r2 := makeTestRaft(2, []uint64{1, 2, 3}, 10, 1, nil, nil)
+	r1.becomeCandidate()
+	r1.becomeLeader()
+	r1.Advance(r1.Ready())
+	r1.messages = nil
+
+	index, _, _ := r1.Propose([]byte("data"))
+	ready := r1.Ready()
+	for i := 0; i < len(ready.Messages); i++ {
+		if ready.Messages[i].To == r2.id {
+			r2.Step(&ready.Messages[i])
+		}
+	}
+	follower := r2.Ready()
+	r2.Advance(follower)
+	for i := 0; i < len(follower.Messages); i++ {
+		r1.Step(&follower.Messages[i])
+	}
+	if r1.getNodeByID(2).Matched < index {
+		t.Fatalf("follower should match %d before leader stabled", index)
+	}
+	if r1.log.CommitIndex() >= index {
+		t.Fatalf("entry %d should not be committed before leader stabled", index)
+	}
+
+	r1.Advance(ready)
+	if r1.log.CommitIndex() != index {
+		t.Fatalf("commit index want: %d, get: %d", index, r1.log.CommitIndex())
+	}
+}
+
+func TestRawNode_Status(t *testing.T) {
+	n := generate(3)
+	n.startElection(1)
+	if !n.waitCommit(1) {
+		t.Fatal("failed to acheive agreement")
+	}
+	n.down(3)
+	n.propose(1, []byte("data"))
+	n.waitCommit(2)
+
+	status := n.peer(1).Status()
+	if status.ID != 1 || !status.State.IsLeader() || status.LeaderID != 1 {
+		t.Fatalf("status want leader 1, get: %+v", status)
+	}
+	if status.Commit != 2 || len(status.ConfState.Nodes) != 3 {
+		t.Fatalf("status want commit: 2 and 3 voters, get: %+v", status)
+	}
+
+	tests := []struct {
+		id      uint64
+		matched uint64
+	}{
+		{2, 2},
+		{3, 1},
+	}
+	for i, test := range tests {
+		progress, ok := status.Progress[test.id]
+		if !ok || progress.Matched != test.matched {
+			t.Fatalf("#%d: progress of %d want matched: %d, get: %+v",
+				i, test.id, test.matched, progress)
+		}
+	}
+	if _, ok := status.Progress[1]; ok {
+		t.Fatalf("leader should not report progress of itself")
+	}
+
+	if follower := n.peer(2).Status(); follower.Progress != nil {
+		t.Fatalf("follower should not report progress: %+v", follower.Progress)
+	}
+}
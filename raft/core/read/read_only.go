@@ -10,6 +10,7 @@ type ReadIndexStatus struct {
 	To      uint64
 	Context []byte
 	Acks    map[uint64]struct{}
+	Sent    int // time heartbeats of request sent, used by lease.
 }
 
 type ReadOnly struct {
@@ -24,8 +25,9 @@ func MakeReadOnly() *ReadOnly {
 	}
 }
 
-// AddRequest add new read request with context.
-func (ro *ReadOnly) AddRequest(index uint64, to uint64, context []byte) {
+// AddRequest add new read request with context, sent is the time
+// heartbeats carrying context are sent.
+func (ro *ReadOnly) AddRequest(index uint64, to uint64, sent int, context []byte) {
 	ctx := string(context)
 	if _, ok := ro.pendingReadIndex[ctx]; ok {
 		return
@@ -34,20 +36,21 @@ func (ro *ReadOnly) AddRequest(index uint64, to uint64, context []byte) {
 		Index:   index,
 		To:      to,
 		Context: context,
-		Acks:    make(map[uint64]struct{})}
+		Acks:    make(map[uint64]struct{}),
+		Sent:    sent}
 	ro.readIndexQueue = append(ro.readIndexQueue, ctx)
 }
 
-// ReceiveAck handle remote heartbeat response with context.
-func (ro *ReadOnly) ReceiveAck(from uint64, context []byte) int {
+// ReceiveAck handle remote heartbeat response with context, and
+// returns the acks of remote nodes for the request.
+func (ro *ReadOnly) ReceiveAck(from uint64, context []byte) map[uint64]struct{} {
 	rs, ok := ro.pendingReadIndex[string(context)]
 	if !ok {
-		return 0
+		return nil
 	}
 
 	rs.Acks[from] = struct{}{}
-	// add one to include an ack from local node
-	return len(rs.Acks) + 1
+	return rs.Acks
 }
 
 // Advance advances the read only request queue kept by the ReadOnly struct.
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// bytesStreamer implements SnapshotStreamer by NodeApplication,
+// it holds whole snapshot data in memory.
+type bytesStreamer struct {
+	application NodeApplication
+
+	// data of snapshot received, wait to restore.
+	buffer *bytesBuffer
+}
+
+// bytesBuffer is a in-memory io.WriteCloser.
+type bytesBuffer struct {
+	bytes.Buffer
+}
+
+func (b *bytesBuffer) Close() error {
+	return nil
+}
+
+func (s *bytesStreamer) OpenSnapshot() (raftpd.SnapshotMetadata, io.ReadCloser) {
+	snapshot := s.application.ReadSnapshot()
+	if snapshot == nil {
+		return raftpd.SnapshotMetadata{}, nil
+	}
+	return snapshot.Metadata, readSeekNopCloser{bytes.NewReader(snapshot.Data)}
+}
+
+func (s *bytesStreamer) CreateSnapshot(metadata *raftpd.SnapshotMetadata) (io.WriteCloser, error) {
+	s.buffer = &bytesBuffer{}
+	return s.buffer, nil
+}
+
+func (s *bytesStreamer) RestoreSnapshot(metadata *raftpd.SnapshotMetadata) {
+	var data []byte
+	if s.buffer != nil {
+		data = s.buffer.Bytes()
+		s.buffer = nil
+	}
+	s.application.ApplySnapshot(&raftpd.Snapshot{
+		Metadata: *metadata,
+		Data:     data,
+	})
+}
+
+// readSeekNopCloser is a io.ReadCloser which keeps io.Seeker
+// of underlying reader, unlike ioutil.NopCloser.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -1,5 +1,10 @@
 package core
 
+import (
+	"github.com/thinkermao/bior/raft/core/peer"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
 // SoftState gives some raft runtime information.
 type SoftState struct {
 	// LeaderID return current node's leader ID.
@@ -10,6 +15,26 @@ type SoftState struct {
 	LastIndex uint64
 }
 
+// Status is a snapshot of raft status, it is used to observe
+// raft, such as which follower is lagging and why.
+type Status struct {
+	ID uint64
+
+	raftpd.HardState
+	SoftState
+
+	// Applied is index of last entry applied by application.
+	Applied   uint64
+	ConfState raftpd.ConfState
+
+	// LeadTransferee is the target of leader transfer
+	// in progress, conf.InvalidID if there is none.
+	LeadTransferee uint64
+	// Progress is the replication progress of other
+	// nodes, it is only available on leader.
+	Progress map[uint64]peer.Progress
+}
+
 // StateRole said the state role of raft.
 type StateRole int
 
@@ -51,3 +76,21 @@ func (role StateRole) IsFollower() bool {
 func (role StateRole) IsPrevCandidate() bool {
 	return role == RolePrevCandidate
 }
+
+// SnapshotStatus is the result of snapshot sending reported by application.
+type SnapshotStatus int
+
+// Snapshot status enum constants.
+const (
+	SnapshotFinish SnapshotStatus = iota
+	SnapshotFailure
+)
+
+var snapshotStatusString = []string{
+	"Finish",
+	"Failure",
+}
+
+func (status SnapshotStatus) String() string {
+	return snapshotStatusString[status]
+}
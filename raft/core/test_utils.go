@@ -50,6 +50,12 @@ func state(state StateRole) raftOpt {
 	}
 }
 
+func readOnlyOption(opt conf.ReadOnlyOption) raftOpt {
+	return func(c *RawNode) {
+		c.readOnlyOption = opt
+	}
+}
+
 func makeTestRaft(
 	id uint64,
 	peers []uint64,
@@ -289,6 +295,12 @@ func (n *network) allCommitted(idx uint64) bool {
 
 func (n *network) stableAllEntries() {
 	for _, peer := range n.peers {
-		peer.log.StableEntries()
+		stableAll(peer)
 	}
 }
+
+// stableAll notice node that all entries have been saved.
+func stableAll(node *RawNode) {
+	last := node.log.LastIndex()
+	node.StableTo(last, node.log.Term(last))
+}
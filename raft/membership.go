@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"sync"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// confEntry is the configuration applied at index.
+type confEntry struct {
+	index uint64
+	state raftpd.ConfState
+}
+
+// membership records configurations applied since last snapshot,
+// so that snapshot could be stamped by configuration at its index.
+type membership struct {
+	mutex sync.Mutex
+	// ascending by index, the first one is at or before last snapshot.
+	history []confEntry
+}
+
+func makeMembership(index uint64, state raftpd.ConfState) *membership {
+	return &membership{
+		history: []confEntry{{index, state}},
+	}
+}
+
+// reset replace all configurations by the one restored from snapshot.
+func (m *membership) reset(index uint64, state raftpd.ConfState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.history = []confEntry{{index, state}}
+}
+
+// add record configuration applied at index.
+func (m *membership) add(index uint64, state raftpd.ConfState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.history = append(m.history, confEntry{index, state})
+}
+
+// lastIndex return index of latest configuration, conf changes
+// at or before it have been applied.
+func (m *membership) lastIndex() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.history[len(m.history)-1].index
+}
+
+// at return configuration at index, that is the latest one applied
+// at or before index. Configurations discarded by compaction are
+// answered by the oldest one kept.
+func (m *membership) at(index uint64) raftpd.ConfState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i := len(m.history) - 1
+	for i > 0 && m.history[i].index > index {
+		i--
+	}
+	return m.history[i].state
+}
+
+// compact discard configurations superseded at index.
+func (m *membership) compact(index uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i := 0
+	for i+1 < len(m.history) && m.history[i+1].index <= index {
+		i++
+	}
+	m.history = m.history[i:]
+}
+
+// ConfState return configuration of raft group at index. Application
+// should record it in metadata of snapshot built at index, so that
+// configuration survives after entries before snapshot discarded.
+func (raft *Raft) ConfState(index uint64) raftpd.ConfState {
+	return raft.membership.at(index)
+}
@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+func makeConfState(nodes ...uint64) raftpd.ConfState {
+	return raftpd.ConfState{Nodes: nodes}
+}
+
+func TestMembership_At(t *testing.T) {
+	m := makeMembership(2, makeConfState(1))
+	m.add(5, makeConfState(1, 2))
+	m.add(8, makeConfState(1, 2, 3))
+
+	tests := []struct {
+		compact uint64 /* compact before query if non zero */
+		index   uint64
+		want    raftpd.ConfState
+	}{
+		{0, 1, makeConfState(1)},
+		{0, 4, makeConfState(1)},
+		{0, 5, makeConfState(1, 2)},
+		{0, 7, makeConfState(1, 2)},
+		{0, 9, makeConfState(1, 2, 3)},
+		{6, 9, makeConfState(1, 2, 3)},
+		/* discarded by compaction */
+		{6, 2, makeConfState(1, 2)},
+		{9, 5, makeConfState(1, 2, 3)},
+	}
+
+	for i, test := range tests {
+		if test.compact != 0 {
+			m.compact(test.compact)
+		}
+		if state := m.at(test.index); !reflect.DeepEqual(state, test.want) {
+			t.Fatalf("#%d: conf state want: %v, get: %v", i, test.want, state)
+		}
+	}
+	if m.lastIndex() != 8 {
+		t.Fatalf("last index want: %d, get: %d", 8, m.lastIndex())
+	}
+}
+
+func TestRebuildRaft_ConfState(t *testing.T) {
+	storage := MakeMemoryStorage(Metadata{})
+	cs := raftpd.ConfState{Nodes: []uint64{1, 2, 3}}
+	storage.SaveConfState(3, &cs)
+
+	raft, err := RebuildRaft(1, []uint64{1}, 50, 10, 5, 1024*1024,
+		storage, &nopApplication{}, nopTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	var state raftpd.ConfState
+	raft.do(func() {
+		state = raft.raft.ReadConfState()
+	})
+	if !reflect.DeepEqual(state.Nodes, cs.Nodes) {
+		t.Fatalf("nodes want: %v, get: %v", cs.Nodes, state.Nodes)
+	}
+	if raft.ConfState(3).Nodes == nil || raft.membership.lastIndex() != 3 {
+		t.Fatalf("membership should start from configuration saved")
+	}
+}
@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"sync"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// MemoryStorage implements the Storage interface backed by
+// an in-memory array, it is useful for tests.
+type MemoryStorage struct {
+	mutex sync.Mutex
+
+	state     raftpd.HardState
+	confIndex uint64
+	confState raftpd.ConfState
+	entries   []raftpd.Entry
+}
+
+// MakeMemoryStorage return a instance of MemoryStorage,
+// which has a dummy entry from meta.
+func MakeMemoryStorage(meta Metadata) *MemoryStorage {
+	return &MemoryStorage{
+		entries: []raftpd.Entry{{
+			Type:  raftpd.EntryNormal,
+			Index: meta.Index,
+			Term:  meta.Term,
+		}},
+	}
+}
+
+// SaveEntries implements Storage.SaveEntries.
+func (ms *MemoryStorage) SaveEntries(entries []raftpd.Entry) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for i := 0; i < len(entries); i++ {
+		if entries[i].Index <= ms.entries[0].Index {
+			/* already compacted */
+			continue
+		}
+		ms.entries = appendEntry(ms.entries, &entries[i])
+	}
+	return nil
+}
+
+// SaveHardState implements Storage.SaveHardState.
+func (ms *MemoryStorage) SaveHardState(state *raftpd.HardState) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.state = *state
+	return nil
+}
+
+// SaveConfState implements Storage.SaveConfState.
+func (ms *MemoryStorage) SaveConfState(index uint64, state *raftpd.ConfState) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.confIndex = index
+	ms.confState = *state
+	return nil
+}
+
+// Sync implements Storage.Sync, it is a no-op.
+func (ms *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Load implements Storage.Load.
+func (ms *MemoryStorage) Load() ([]raftpd.Entry, raftpd.HardState, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries := make([]raftpd.Entry, len(ms.entries))
+	copy(entries, ms.entries)
+	return entries, ms.state, nil
+}
+
+// LoadConfState implements Storage.LoadConfState.
+func (ms *MemoryStorage) LoadConfState() (uint64, raftpd.ConfState, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.confIndex, ms.confState, nil
+}
+
+// Compact implements Storage.Compact.
+func (ms *MemoryStorage) Compact(meta Metadata) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.entries = compactEntries(ms.entries, meta)
+	return nil
+}
+
+// Close implements Storage.Close, it is a no-op.
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
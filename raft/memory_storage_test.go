@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+func makeEntries(idxs ...uint64) []raftpd.Entry {
+	entries := []raftpd.Entry{}
+	for _, i := range idxs {
+		entries = append(entries, raftpd.Entry{Index: i, Term: i})
+	}
+	return entries
+}
+
+func compareEntries(t *testing.T, i int, a, want []raftpd.Entry) {
+	if len(a) != len(want) {
+		t.Fatalf("#%d: len(entries) want: %d, get: %d",
+			i, len(want), len(a))
+	}
+	for j := 0; j < len(a); j++ {
+		if a[j].Index != want[j].Index || a[j].Term != want[j].Term {
+			t.Fatalf("#%d: ents[%d] want: %v, get: %v",
+				i, j, want[j], a[j])
+		}
+	}
+}
+
+func TestMemoryStorage_SaveEntries(t *testing.T) {
+	tests := []struct {
+		saves [][]raftpd.Entry
+		want  []raftpd.Entry
+	}{
+		{[][]raftpd.Entry{makeEntries(2, 3)}, makeEntries(1, 2, 3)},
+		{[][]raftpd.Entry{makeEntries(2, 3), makeEntries(3, 4)}, makeEntries(1, 2, 3, 4)},
+		{[][]raftpd.Entry{makeEntries(2, 3, 4), makeEntries(3)}, makeEntries(1, 2, 3)},
+		/* compacted entries are ignored */
+		{[][]raftpd.Entry{makeEntries(1, 2)}, makeEntries(1, 2)},
+	}
+
+	for i, test := range tests {
+		ms := MakeMemoryStorage(Metadata{Index: 1, Term: 1})
+		for _, entries := range test.saves {
+			if err := ms.SaveEntries(entries); err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+		}
+		entries, _, _ := ms.Load()
+		compareEntries(t, i, entries, test.want)
+	}
+}
+
+func TestMemoryStorage_Compact(t *testing.T) {
+	tests := []struct {
+		meta Metadata
+		want []raftpd.Entry
+	}{
+		{Metadata{Index: 0, Term: 0}, makeEntries(1, 2, 3, 4)},
+		{Metadata{Index: 2, Term: 2}, makeEntries(2, 3, 4)},
+		{Metadata{Index: 4, Term: 4}, makeEntries(4)},
+		{Metadata{Index: 6, Term: 6}, makeEntries(6)},
+	}
+
+	for i, test := range tests {
+		ms := MakeMemoryStorage(Metadata{Index: 1, Term: 1})
+		ms.SaveEntries(makeEntries(2, 3, 4))
+		ms.Compact(test.meta)
+
+		entries, _, _ := ms.Load()
+		compareEntries(t, i, entries, test.want)
+	}
+}
+
+func TestMemoryStorage_SaveHardState(t *testing.T) {
+	ms := MakeMemoryStorage(Metadata{})
+	hs := raftpd.HardState{Vote: 1, Term: 2, Commit: 3}
+	ms.SaveHardState(&hs)
+
+	_, state, _ := ms.Load()
+	if state != hs {
+		t.Fatalf("hard state want: %v, get: %v", hs, state)
+	}
+}
+
+func TestMemoryStorage_SaveConfState(t *testing.T) {
+	ms := MakeMemoryStorage(Metadata{})
+	if index, _, _ := ms.LoadConfState(); index != 0 {
+		t.Fatalf("conf index want: 0, get: %d", index)
+	}
+
+	cs := raftpd.ConfState{Nodes: []uint64{1, 2}, Learners: []uint64{3}}
+	ms.SaveConfState(5, &cs)
+
+	index, state, _ := ms.LoadConfState()
+	if index != 5 || !reflect.DeepEqual(state, cs) {
+		t.Fatalf("conf state want: %d %v, get: %d %v", 5, cs, index, state)
+	}
+}
@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/thinkermao/bior/raft/core"
+)
+
+// Metrics observes raft, it is set by Config.Metrics. Methods
+// are called by multiple goroutines, so they must be thread-safe
+// and never block. Package metrics provides a Prometheus
+// compatible implementation.
+type Metrics interface {
+	// SetTerm, SetCommitIndex and SetAppliedIndex report
+	// progress of local node.
+	SetTerm(term uint64)
+	SetCommitIndex(index uint64)
+	SetAppliedIndex(index uint64)
+	// LeaderChanged report that leader known by local
+	// node is changed, leader is conf.InvalidID if lost.
+	LeaderChanged(leader uint64)
+
+	// ProposalAccepted and ProposalDropped report result of
+	// proposal, including conf change proposal.
+	ProposalAccepted()
+	ProposalDropped()
+
+	// ObserveSave report time spent writing entries and hard state
+	// of a Ready to storage, ObserveSync report time spent syncing.
+	ObserveSave(d time.Duration)
+	ObserveSync(d time.Duration)
+	// ObserveReady report size of a Ready.
+	ObserveReady(entries, committed, messages int)
+
+	// SetPeerLags report entries each node lags behind leader, it
+	// replaces lags reported before, and is nil if not leader.
+	SetPeerLags(lags map[uint64]uint64)
+	// SnapshotSent report that leader begins sending snapshot to node.
+	SnapshotSent(nodeID uint64)
+
+	// ObserveReadIndex report time spent by a successful ReadIndex.
+	ObserveReadIndex(d time.Duration)
+}
+
+// nopMetrics is used if Config.Metrics is nil.
+type nopMetrics struct{}
+
+func (nopMetrics) SetTerm(term uint64)                           {}
+func (nopMetrics) SetCommitIndex(index uint64)                   {}
+func (nopMetrics) SetAppliedIndex(index uint64)                  {}
+func (nopMetrics) LeaderChanged(leader uint64)                   {}
+func (nopMetrics) ProposalAccepted()                             {}
+func (nopMetrics) ProposalDropped()                              {}
+func (nopMetrics) ObserveSave(d time.Duration)                   {}
+func (nopMetrics) ObserveSync(d time.Duration)                   {}
+func (nopMetrics) ObserveReady(entries, committed, messages int) {}
+func (nopMetrics) SetPeerLags(lags map[uint64]uint64)            {}
+func (nopMetrics) SnapshotSent(nodeID uint64)                    {}
+func (nopMetrics) ObserveReadIndex(d time.Duration)              {}
+
+// proposed report result of proposal to metrics.
+func (raft *Raft) proposed(isLeader bool) {
+	if isLeader {
+		raft.metrics.ProposalAccepted()
+	} else {
+		raft.metrics.ProposalDropped()
+	}
+}
+
+// observeReady report term, commit index, leader and size of ready.
+func (raft *Raft) observeReady(ready *core.Ready) {
+	raft.metrics.ObserveReady(len(ready.Entries),
+		len(ready.CommitEntries), len(ready.Messages))
+	if ready.HS != nil {
+		raft.metrics.SetTerm(ready.HS.Term)
+		raft.metrics.SetCommitIndex(ready.HS.Commit)
+	}
+	if ready.SS != nil && ready.SS.LeaderID != raft.leader {
+		raft.leader = ready.SS.LeaderID
+		raft.metrics.LeaderChanged(raft.leader)
+	}
+}
+
+// observePeers report replication lag of nodes if leader, lag is
+// the number of entries leader has but node hasn't matched.
+func (raft *Raft) observePeers() {
+	status := raft.raft.Status()
+	if !status.State.IsLeader() {
+		if raft.lagReported {
+			raft.lagReported = false
+			raft.metrics.SetPeerLags(nil)
+		}
+		return
+	}
+
+	lags := make(map[uint64]uint64, len(status.Progress))
+	for id, progress := range status.Progress {
+		var lag uint64
+		if progress.Matched < status.LastIndex {
+			lag = status.LastIndex - progress.Matched
+		}
+		lags[id] = lag
+	}
+	raft.lagReported = true
+	raft.metrics.SetPeerLags(lags)
+}
@@ -0,0 +1,277 @@
+// Package metrics provides an implementation of raft.Metrics, which
+// keeps metrics in memory and exposes them in Prometheus text format,
+// so they could be scraped without any client library.
+//
+// Usage:
+//
+//	m := metrics.MakePrometheus("bior")
+//	http.Handle("/metrics", m)
+//
+//	config.Metrics = m
+//	raft, err := raft.StartRaft(config)
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// contentType is the content type of Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// latencyBuckets are upper bounds in seconds, from 100us to 3.2s.
+	latencyBuckets = exponentialBuckets(0.0001, 2, 16)
+	// sizeBuckets are upper bounds of Ready sizes, from 1 to 4096.
+	sizeBuckets = exponentialBuckets(1, 2, 13)
+)
+
+// Prometheus implements raft.Metrics, and http.Handler serves
+// metrics in Prometheus text format. Prometheus is thread-safe.
+type Prometheus struct {
+	mutex     sync.Mutex
+	namespace string
+
+	term          uint64
+	commit        uint64
+	applied       uint64
+	leader        uint64
+	leaderChanges uint64
+
+	proposalsAccepted uint64
+	proposalsDropped  uint64
+
+	saveLatency      *histogram
+	syncLatency      *histogram
+	readIndexLatency *histogram
+
+	readyEntries   *histogram
+	readyCommitted *histogram
+	readyMessages  *histogram
+
+	peerLags      map[uint64]uint64
+	snapshotsSent map[uint64]uint64
+}
+
+// MakePrometheus return Prometheus whose metric names are
+// prefixed by namespace, such as bior_raft_term.
+func MakePrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		namespace:        namespace,
+		saveLatency:      makeHistogram(latencyBuckets),
+		syncLatency:      makeHistogram(latencyBuckets),
+		readIndexLatency: makeHistogram(latencyBuckets),
+		readyEntries:     makeHistogram(sizeBuckets),
+		readyCommitted:   makeHistogram(sizeBuckets),
+		readyMessages:    makeHistogram(sizeBuckets),
+		snapshotsSent:    make(map[uint64]uint64),
+	}
+}
+
+func (p *Prometheus) SetTerm(term uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.term = term
+}
+
+func (p *Prometheus) SetCommitIndex(index uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.commit = index
+}
+
+func (p *Prometheus) SetAppliedIndex(index uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.applied = index
+}
+
+func (p *Prometheus) LeaderChanged(leader uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.leader = leader
+	p.leaderChanges++
+}
+
+func (p *Prometheus) ProposalAccepted() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.proposalsAccepted++
+}
+
+func (p *Prometheus) ProposalDropped() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.proposalsDropped++
+}
+
+func (p *Prometheus) ObserveSave(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.saveLatency.observe(d.Seconds())
+}
+
+func (p *Prometheus) ObserveSync(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.syncLatency.observe(d.Seconds())
+}
+
+func (p *Prometheus) ObserveReady(entries, committed, messages int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.readyEntries.observe(float64(entries))
+	p.readyCommitted.observe(float64(committed))
+	p.readyMessages.observe(float64(messages))
+}
+
+func (p *Prometheus) SetPeerLags(lags map[uint64]uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.peerLags = make(map[uint64]uint64, len(lags))
+	for id, lag := range lags {
+		p.peerLags[id] = lag
+	}
+}
+
+func (p *Prometheus) SnapshotSent(nodeID uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.snapshotsSent[nodeID]++
+}
+
+func (p *Prometheus) ObserveReadIndex(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.readIndexLatency.observe(d.Seconds())
+}
+
+// ServeHTTP write metrics in Prometheus text format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	if _, err := p.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// WriteTo write metrics in Prometheus text format to w.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+
+	p.mutex.Lock()
+	p.writeGauge(buf, "term", "Current term.", p.term)
+	p.writeGauge(buf, "commit_index", "Index of last entry committed.", p.commit)
+	p.writeGauge(buf, "applied_index", "Index of last entry applied.", p.applied)
+	p.writeGauge(buf, "leader", "ID of leader, 0 if there is no leader.", p.leader)
+	p.writeCounter(buf, "leader_changes_total", "Number of leader changes seen.", p.leaderChanges)
+	p.writeCounter(buf, "proposals_accepted_total", "Number of proposals accepted.", p.proposalsAccepted)
+	p.writeCounter(buf, "proposals_dropped_total", "Number of proposals dropped.", p.proposalsDropped)
+	p.writeHistogram(buf, "wal_save_seconds", "Latency of saving a Ready to storage.", p.saveLatency)
+	p.writeHistogram(buf, "wal_sync_seconds", "Latency of syncing storage.", p.syncLatency)
+	p.writeHistogram(buf, "ready_entries", "Number of entries to save in a Ready.", p.readyEntries)
+	p.writeHistogram(buf, "ready_committed_entries", "Number of entries committed in a Ready.", p.readyCommitted)
+	p.writeHistogram(buf, "ready_messages", "Number of messages to send in a Ready.", p.readyMessages)
+	p.writePeers(buf, "peer_lag_entries", "gauge", "Entries peer lags behind leader.", p.peerLags)
+	p.writePeers(buf, "snapshots_sent_total", "counter", "Number of snapshots sent to peer.", p.snapshotsSent)
+	p.writeHistogram(buf, "read_index_seconds", "Latency of ReadIndex.", p.readIndexLatency)
+	p.mutex.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+func (p *Prometheus) name(name string) string {
+	if p.namespace == "" {
+		return "raft_" + name
+	}
+	return p.namespace + "_raft_" + name
+}
+
+func (p *Prometheus) writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *Prometheus) writeGauge(buf *bytes.Buffer, name, help string, value uint64) {
+	name = p.name(name)
+	p.writeHeader(buf, name, "gauge", help)
+	fmt.Fprintf(buf, "%s %d\n", name, value)
+}
+
+func (p *Prometheus) writeCounter(buf *bytes.Buffer, name, help string, value uint64) {
+	name = p.name(name)
+	p.writeHeader(buf, name, "counter", help)
+	fmt.Fprintf(buf, "%s %d\n", name, value)
+}
+
+// writePeers write a metric labeled by peer, in ascending order of id.
+func (p *Prometheus) writePeers(buf *bytes.Buffer, name, typ, help string, values map[uint64]uint64) {
+	name = p.name(name)
+	p.writeHeader(buf, name, typ, help)
+
+	ids := make([]uint64, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%s{peer=\"%d\"} %d\n", name, id, values[id])
+	}
+}
+
+func (p *Prometheus) writeHistogram(buf *bytes.Buffer, name, help string, h *histogram) {
+	name = p.name(name)
+	p.writeHeader(buf, name, "histogram", help)
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count %d\n", name, h.count)
+}
+
+// histogram counts observations in buckets, counts[i] is the number
+// of observations in (bounds[i-1], bounds[i]], observations greater
+// than the last bound are counted only by count.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func makeHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := 0; i < count; i++ {
+		buckets[i] = start * math.Pow(factor, float64(i))
+	}
+	return buckets
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft"
+)
+
+var _ raft.Metrics = (*Prometheus)(nil)
+
+func TestPrometheus_WriteTo(t *testing.T) {
+	p := MakePrometheus("bior")
+	p.SetTerm(3)
+	p.SetCommitIndex(10)
+	p.SetAppliedIndex(9)
+	p.LeaderChanged(2)
+	p.ProposalAccepted()
+	p.ProposalAccepted()
+	p.ProposalDropped()
+	p.ObserveSync(300 * time.Microsecond)
+	p.ObserveSync(time.Hour)
+	p.ObserveReady(3, 2, 0)
+	p.SetPeerLags(map[uint64]uint64{3: 5, 2: 0})
+	p.SnapshotSent(3)
+
+	buf := &bytes.Buffer{}
+	if _, err := p.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+
+	tests := []string{
+		"# TYPE bior_raft_term gauge\nbior_raft_term 3\n",
+		"bior_raft_commit_index 10\n",
+		"bior_raft_applied_index 9\n",
+		"bior_raft_leader 2\n",
+		"bior_raft_leader_changes_total 1\n",
+		"bior_raft_proposals_accepted_total 2\n",
+		"bior_raft_proposals_dropped_total 1\n",
+		"bior_raft_wal_sync_seconds_bucket{le=\"0.0002\"} 0\n",
+		"bior_raft_wal_sync_seconds_bucket{le=\"0.0004\"} 1\n",
+		"bior_raft_wal_sync_seconds_bucket{le=\"+Inf\"} 2\n",
+		"bior_raft_wal_sync_seconds_count 2\n",
+		"bior_raft_ready_entries_bucket{le=\"2\"} 0\n",
+		"bior_raft_ready_entries_bucket{le=\"4\"} 1\n",
+		"bior_raft_ready_messages_bucket{le=\"1\"} 1\n",
+		"bior_raft_peer_lag_entries{peer=\"2\"} 0\nbior_raft_peer_lag_entries{peer=\"3\"} 5\n",
+		"bior_raft_snapshots_sent_total{peer=\"3\"} 1\n",
+		"bior_raft_read_index_seconds_count 0\n",
+	}
+	for i, want := range tests {
+		if !strings.Contains(text, want) {
+			t.Fatalf("#%d: want %q in:\n%s", i, want, text)
+		}
+	}
+
+	p.SetPeerLags(nil)
+	buf.Reset()
+	p.WriteTo(buf)
+	if strings.Contains(buf.String(), "bior_raft_peer_lag_entries{") {
+		t.Fatalf("peer lags should be cleared:\n%s", buf.String())
+	}
+}
+
+func TestPrometheus_ServeHTTP(t *testing.T) {
+	p := MakePrometheus("")
+	p.SetTerm(1)
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); ct != contentType {
+		t.Fatalf("content type want %s, get %s", contentType, ct)
+	}
+	if !strings.Contains(recorder.Body.String(), "\nraft_term 1\n") {
+		t.Fatalf("metrics should be served:\n%s", recorder.Body.String())
+	}
+}
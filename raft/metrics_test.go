@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/core/conf"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+type recordMetrics struct {
+	nopMetrics
+	mutex    sync.Mutex
+	leader   uint64
+	accepted int
+	dropped  int
+	applied  uint64
+	saves    int
+	syncs    int
+	reads    int
+}
+
+func (m *recordMetrics) LeaderChanged(leader uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.leader = leader
+}
+
+func (m *recordMetrics) ProposalAccepted() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.accepted++
+}
+
+func (m *recordMetrics) ProposalDropped() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dropped++
+}
+
+func (m *recordMetrics) SetAppliedIndex(index uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.applied = index
+}
+
+func (m *recordMetrics) ObserveSave(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.saves++
+}
+
+func (m *recordMetrics) ObserveSync(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.syncs++
+}
+
+func (m *recordMetrics) ObserveReadIndex(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reads++
+}
+
+func TestRaft_Metrics(t *testing.T) {
+	metrics := &recordMetrics{}
+	config := &Config{
+		ID:               1,
+		Nodes:            []uint64{1},
+		ElectionTimeout:  50,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		Metrics:          metrics,
+		Application:      &nopApplication{},
+		Transport:        nopTransport{},
+	}
+	state := raftpd.HardState{Vote: conf.InvalidID}
+	raft := buildRaft(config, MakeMemoryStorage(Metadata{}), nil,
+		state, conf.InvalidIndex, raftpd.ConfState{Nodes: []uint64{1}})
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var index uint64
+	for {
+		var err error
+		index, err = raft.ProposeWait(ctx, nil)
+		if err == nil {
+			break
+		} else if err != ErrNotLeader {
+			t.Fatalf("propose wait: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := raft.ReadIndex(ctx); err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+
+	for {
+		metrics.mutex.Lock()
+		applied := metrics.applied
+		metrics.mutex.Unlock()
+		if applied >= index {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("applied index want %d, get %d", index, applied)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if metrics.leader != 1 {
+		t.Fatalf("leader want 1, get %d", metrics.leader)
+	}
+	if metrics.accepted != 1 {
+		t.Fatalf("accepted proposals want 1, get %d", metrics.accepted)
+	}
+	if metrics.saves == 0 || metrics.syncs == 0 || metrics.reads != 1 {
+		t.Fatalf("saves, syncs and reads should be observed, get %d, %d, %d",
+			metrics.saves, metrics.syncs, metrics.reads)
+	}
+}
@@ -0,0 +1,167 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+var (
+	// ErrNotLeader means proposal is rejected because node isn't leader.
+	ErrNotLeader = errors.New("raft: not leader")
+	// ErrProposalOverwritten means entry of proposal is overwritten by
+	// entry of later term, so it will never be applied.
+	ErrProposalOverwritten = errors.New("raft: proposal overwritten by later term")
+	// ErrLeadershipLost means leadership is lost before proposal applied,
+	// the entry might be applied or not.
+	ErrLeadershipLost = errors.New("raft: leadership lost before proposal applied")
+)
+
+// Future is the result of proposal, it is resolved after entry at
+// (Index, Term) applied, or proposal failed.
+type Future struct {
+	Index uint64
+	Term  uint64
+
+	done chan struct{}
+	err  error
+}
+
+func makeFuture(index, term uint64) *Future {
+	return &Future{
+		Index: index,
+		Term:  term,
+		done:  make(chan struct{}),
+	}
+}
+
+// Done return a channel closed after future resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err return nil if entry is applied, it is valid after Done closed.
+func (f *Future) Err() error {
+	return f.err
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// proposalTracker holds futures of proposals waiting to be applied.
+type proposalTracker struct {
+	mutex   sync.Mutex
+	pending map[uint64]*Future
+}
+
+func makeProposalTracker() *proposalTracker {
+	return &proposalTracker{
+		pending: make(map[uint64]*Future),
+	}
+}
+
+func (t *proposalTracker) register(future *Future) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	/* index is reused only if old entry is overwritten */
+	if old, ok := t.pending[future.Index]; ok {
+		old.resolve(ErrProposalOverwritten)
+	}
+	t.pending[future.Index] = future
+}
+
+// cancel stop tracking future, it won't be resolved after return.
+func (t *proposalTracker) cancel(future *Future) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.pending[future.Index] == future {
+		delete(t.pending, future.Index)
+	}
+}
+
+// applied resolve future of proposal at index of entry.
+func (t *proposalTracker) applied(entry *raftpd.Entry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	future, ok := t.pending[entry.Index]
+	if !ok {
+		return
+	}
+	delete(t.pending, entry.Index)
+	if future.Term == entry.Term {
+		future.resolve(nil)
+	} else {
+		future.resolve(ErrProposalOverwritten)
+	}
+}
+
+// failAll resolve all futures with err.
+func (t *proposalTracker) failAll(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for index, future := range t.pending {
+		future.resolve(err)
+		delete(t.pending, index)
+	}
+}
+
+// failBefore resolve futures proposed at or before term with err.
+func (t *proposalTracker) failBefore(term uint64, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for index, future := range t.pending {
+		if future.Term <= term {
+			future.resolve(err)
+			delete(t.pending, index)
+		}
+	}
+}
+
+// Propose propose data, and return a future resolved after
+// entry applied. It returns ErrNotLeader if node isn't leader.
+func (raft *Raft) Propose(data []byte) (future *Future, err error) {
+	raft.applier.throttle()
+	err = ErrNotLeader
+	if !raft.do(func() {
+		index, term, isLeader := raft.raft.Propose(data)
+		raft.proposed(isLeader)
+		if !isLeader {
+			return
+		}
+
+		future = makeFuture(index, term)
+		raft.proposals.register(future)
+		err = nil
+	}) {
+		return nil, ErrStopped
+	}
+	return
+}
+
+// ProposeWait propose data, and block until entry applied. It return
+// ErrProposalOverwritten or ErrLeadershipLost if proposal failed,
+// ErrStopped or storage failure if raft stopped, or ctx.Err()
+// if ctx is done before that.
+func (raft *Raft) ProposeWait(ctx context.Context, data []byte) (uint64, error) {
+	future, err := raft.Propose(data)
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-future.Done():
+		return future.Index, future.Err()
+	case <-ctx.Done():
+		raft.proposals.cancel(future)
+		return future.Index, ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+)
+
+type nopTransport struct{}
+
+func (nopTransport) Send(to uint64, msg pd.Messager) error { return nil }
+
+type nopApplication struct {
+	mutex   sync.Mutex
+	applied []uint64
+}
+
+func (app *nopApplication) ApplyEntry(entry *raftpd.Entry) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.applied = append(app.applied, entry.Index)
+}
+
+func (app *nopApplication) ReadStateNotice(idx uint64, bytes []byte) {}
+
+func (app *nopApplication) ApplySnapshot(snapshot *raftpd.Snapshot) {}
+
+func (app *nopApplication) ReadSnapshot() *raftpd.Snapshot {
+	return &raftpd.Snapshot{}
+}
+
+func resolved(future *Future) bool {
+	select {
+	case <-future.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestProposalTracker(t *testing.T) {
+	tests := []struct {
+		entry   raftpd.Entry
+		fail    uint64 /* fail proposals before term if non zero */
+		done    bool
+		wantErr error
+	}{
+		{raftpd.Entry{Index: 2, Term: 2}, 0, true, nil},
+		{raftpd.Entry{Index: 2, Term: 3}, 0, true, ErrProposalOverwritten},
+		{raftpd.Entry{Index: 3, Term: 2}, 0, false, nil},
+		{raftpd.Entry{Index: 3, Term: 2}, 2, true, ErrLeadershipLost},
+		{raftpd.Entry{Index: 3, Term: 2}, 1, false, nil},
+	}
+
+	for i, test := range tests {
+		tracker := makeProposalTracker()
+		future := makeFuture(2, 2)
+		tracker.register(future)
+		tracker.applied(&test.entry)
+		if test.fail != 0 {
+			tracker.failBefore(test.fail, ErrLeadershipLost)
+		}
+
+		if resolved(future) != test.done {
+			t.Fatalf("#%d: done want: %v, get: %v", i, test.done, resolved(future))
+		}
+		if test.done && future.Err() != test.wantErr {
+			t.Fatalf("#%d: err want: %v, get: %v", i, test.wantErr, future.Err())
+		}
+	}
+}
+
+func TestProposalTracker_Reregister(t *testing.T) {
+	tracker := makeProposalTracker()
+	old := makeFuture(2, 2)
+	tracker.register(old)
+	future := makeFuture(2, 3)
+	tracker.register(future)
+	if !resolved(old) || old.Err() != ErrProposalOverwritten {
+		t.Fatalf("old proposal should be overwritten")
+	}
+
+	tracker.cancel(future)
+	tracker.applied(&raftpd.Entry{Index: 2, Term: 3})
+	if resolved(future) {
+		t.Fatalf("canceled proposal should not be resolved")
+	}
+}
+
+func TestRaft_ProposeWait(t *testing.T) {
+	app := &nopApplication{}
+	raft, err := MakeRaft(1, []uint64{1}, 50, 10, 5, 1024*1024,
+		MakeMemoryStorage(Metadata{}), app, nopTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var index uint64
+	for {
+		index, err = raft.ProposeWait(ctx, []byte("hello"))
+		if err != ErrNotLeader {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("propose wait: %v", err)
+	}
+
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if len(app.applied) == 0 || app.applied[len(app.applied)-1] != index {
+		t.Fatalf("entry %d should be applied before return, applied: %v", index, app.applied)
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := raft.ProposeWait(canceled, []byte("world")); err != context.Canceled {
+		t.Fatalf("canceled propose want: %v, get: %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,145 @@
+package raftpd
+
+import "github.com/thinkermao/bior/utils/pd"
+
+// Implements of pd.BinaryMessager, fields are encoded in order of
+// declaration, new fields should be appended to the end. Otherwise
+// binary codec version must be bumped, and older layout is decoded
+// by pd.Decoder.Version.
+
+func (e *HardState) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(e.Vote)
+	enc.PutUvarint(e.Term)
+	enc.PutUvarint(e.Commit)
+}
+
+func (e *HardState) DecodeFrom(dec *pd.Decoder) {
+	e.Vote = dec.Uvarint()
+	e.Term = dec.Uvarint()
+	e.Commit = dec.Uvarint()
+}
+
+func (e *Entry) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(e.Index)
+	enc.PutUvarint(e.Term)
+	enc.PutUvarint(uint64(e.Type))
+	enc.PutBytes(e.Data)
+}
+
+func (e *Entry) DecodeFrom(dec *pd.Decoder) {
+	e.Index = dec.Uvarint()
+	e.Term = dec.Uvarint()
+	e.Type = EntryType(dec.Uvarint())
+	e.Data = dec.Bytes()
+}
+
+func (e *SnapshotMetadata) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(e.Index)
+	enc.PutUvarint(e.Term)
+	e.ConfState.EncodeTo(enc)
+}
+
+func (e *SnapshotMetadata) DecodeFrom(dec *pd.Decoder) {
+	e.Index = dec.Uvarint()
+	e.Term = dec.Uvarint()
+	/* version 1 has no conf state */
+	if dec.Version() >= 2 {
+		e.ConfState.DecodeFrom(dec)
+	}
+}
+
+func (s *Snapshot) EncodeTo(enc *pd.Encoder) {
+	s.Metadata.EncodeTo(enc)
+	enc.PutBytes(s.Data)
+}
+
+func (s *Snapshot) DecodeFrom(dec *pd.Decoder) {
+	s.Metadata.DecodeFrom(dec)
+	s.Data = dec.Bytes()
+}
+
+func (c *Message) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(uint64(c.MsgType))
+	enc.PutUvarint(c.From)
+	enc.PutUvarint(c.To)
+	enc.PutUvarint(c.Index)
+	enc.PutUvarint(c.Term)
+	enc.PutUvarint(c.LogIndex)
+	enc.PutUvarint(c.LogTerm)
+	enc.PutBool(c.Reject)
+	enc.PutUvarint(c.RejectHint)
+	enc.PutUvarint(uint64(len(c.Entries)))
+	for i := 0; i < len(c.Entries); i++ {
+		c.Entries[i].EncodeTo(enc)
+	}
+	enc.PutBool(c.Snapshot != nil)
+	if c.Snapshot != nil {
+		c.Snapshot.EncodeTo(enc)
+	}
+	enc.PutBytes(c.Context)
+	enc.PutUvarint(c.Offset)
+	enc.PutBool(c.Done)
+}
+
+func (c *Message) DecodeFrom(dec *pd.Decoder) {
+	c.MsgType = MessageType(dec.Uvarint())
+	c.From = dec.Uvarint()
+	c.To = dec.Uvarint()
+	c.Index = dec.Uvarint()
+	c.Term = dec.Uvarint()
+	c.LogIndex = dec.Uvarint()
+	c.LogTerm = dec.Uvarint()
+	c.Reject = dec.Bool()
+	c.RejectHint = dec.Uvarint()
+	if size := dec.Uvarint(); size > 0 && dec.Err() == nil {
+		c.Entries = make([]Entry, 0, minInt(size, 1024))
+		for i := uint64(0); i < size && dec.Err() == nil; i++ {
+			var entry Entry
+			entry.DecodeFrom(dec)
+			c.Entries = append(c.Entries, entry)
+		}
+	}
+	if dec.Bool() {
+		c.Snapshot = &Snapshot{}
+		c.Snapshot.DecodeFrom(dec)
+	}
+	c.Context = dec.Bytes()
+	c.Offset = dec.Uvarint()
+	c.Done = dec.Bool()
+}
+
+func (c *ConfState) EncodeTo(enc *pd.Encoder) {
+	enc.PutUint64s(c.Nodes)
+	enc.PutUint64s(c.Learners)
+	enc.PutUint64s(c.OutgoingNodes)
+}
+
+func (c *ConfState) DecodeFrom(dec *pd.Decoder) {
+	c.Nodes = dec.Uint64s()
+	c.Learners = dec.Uint64s()
+	c.OutgoingNodes = dec.Uint64s()
+}
+
+func (c *ConfChange) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(c.ID)
+	enc.PutUvarint(uint64(c.ChangeType))
+	enc.PutUvarint(c.NodeID)
+	enc.PutUint64s(c.AddNodes)
+	enc.PutUint64s(c.RemoveNodes)
+}
+
+func (c *ConfChange) DecodeFrom(dec *pd.Decoder) {
+	c.ID = dec.Uvarint()
+	c.ChangeType = ConfChangeType(dec.Uvarint())
+	c.NodeID = dec.Uvarint()
+	c.AddNodes = dec.Uint64s()
+	c.RemoveNodes = dec.Uint64s()
+}
+
+// minInt limits capacity preallocated by untrusted length.
+func minInt(a uint64, b int) int {
+	if a < uint64(b) {
+		return int(a)
+	}
+	return b
+}
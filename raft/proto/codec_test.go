@@ -0,0 +1,132 @@
+package raftpd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/utils/pd"
+)
+
+func makeTestMessage() *Message {
+	return &Message{
+		MsgType:    MsgSnapshotRequest,
+		From:       1,
+		To:         maxUint64,
+		Index:      10,
+		Term:       2,
+		LogIndex:   9,
+		LogTerm:    1,
+		Reject:     true,
+		RejectHint: 3,
+		Entries: []Entry{
+			{Index: 10, Term: 2, Type: EntryNormal, Data: []byte("hello")},
+			{Index: 11, Term: 2, Type: EntryConfChange},
+		},
+		Snapshot: &Snapshot{
+			Metadata: SnapshotMetadata{
+				Index:     8,
+				Term:      1,
+				ConfState: ConfState{Nodes: []uint64{1, 2, 3}, Learners: []uint64{4}},
+			},
+			Data: []byte("snapshot"),
+		},
+		Context: []byte("ctx"),
+		Offset:  1024,
+		Done:    true,
+	}
+}
+
+const maxUint64 = ^uint64(0)
+
+func TestCodec_Message(t *testing.T) {
+	codecs := []pd.Codec{pd.BinaryCodec, pd.GobCodec}
+	for i, encoder := range codecs {
+		for j, decoder := range codecs {
+			msg := makeTestMessage()
+			data, err := encoder.Marshal(msg)
+			if err != nil {
+				t.Fatalf("#%d marshal failed: %v", i, err)
+			}
+
+			var get Message
+			if err := decoder.Unmarshal(&get, data); err != nil {
+				t.Fatalf("#%d.%d unmarshal failed: %v", i, j, err)
+			}
+			if !reflect.DeepEqual(&get, msg) {
+				t.Fatalf("#%d.%d want: %v, get: %v", i, j, msg, &get)
+			}
+		}
+	}
+}
+
+func TestCodec_ConfChange(t *testing.T) {
+	cc := &ConfChange{
+		ID:          1,
+		ChangeType:  ConfChangeEnterJoint,
+		AddNodes:    []uint64{4, 5},
+		RemoveNodes: []uint64{2, 3},
+	}
+	data := pd.MustMarshal(cc)
+
+	var get ConfChange
+	pd.MustUnmarshal(&get, data)
+	if !reflect.DeepEqual(&get, cc) {
+		t.Fatalf("want: %v, get: %v", cc, &get)
+	}
+}
+
+// TestCodec_MarshalGob tests that data encoded by default could
+// be decoded by nodes only support gob.
+func TestCodec_MarshalGob(t *testing.T) {
+	msg := makeTestMessage()
+	data := pd.MustMarshal(msg)
+	gob, _ := pd.GobCodec.Marshal(msg)
+	if !reflect.DeepEqual(data, gob) {
+		t.Fatalf("default codec should be gob")
+	}
+}
+
+func TestCodec_Truncated(t *testing.T) {
+	data, _ := pd.BinaryCodec.Marshal(makeTestMessage())
+	for i := 2; i < len(data); i++ {
+		var msg Message
+		if err := pd.Unmarshal(&msg, data[:i]); err == nil {
+			t.Fatalf("#%d truncated data should fail", i)
+		}
+	}
+}
+
+func TestCodec_BinarySmallerThanGob(t *testing.T) {
+	msg := makeTestMessage()
+	binary, _ := pd.BinaryCodec.Marshal(msg)
+	gob, _ := pd.GobCodec.Marshal(msg)
+	if len(binary) >= len(gob) {
+		t.Fatalf("binary size: %d, gob size: %d", len(binary), len(gob))
+	}
+}
+
+func TestCodec_Version1(t *testing.T) {
+	// snapshot encoded by version 1, metadata has no conf state.
+	enc := &pd.Encoder{}
+	enc.PutUvarint(8)
+	enc.PutUvarint(1)
+	enc.PutBytes([]byte("snapshot"))
+	data := append([]byte{0xB1, 1}, enc.Bytes()...)
+
+	var get Snapshot
+	if err := pd.Unmarshal(&get, data); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	want := Snapshot{
+		Metadata: SnapshotMetadata{Index: 8, Term: 1},
+		Data:     []byte("snapshot"),
+	}
+	if !reflect.DeepEqual(get, want) {
+		t.Fatalf("want: %v, get: %v", want, get)
+	}
+
+	data[1] = 3
+	if err := pd.Unmarshal(&get, data); err == nil {
+		t.Fatalf("unknown version should fail")
+	}
+}
@@ -13,6 +13,7 @@ type MessageType int
 // - Snapshot request
 // - Heartbeat request
 // - ReadIndex response
+// - TimeoutNow request
 //
 // Message from follower:
 // - Append response
@@ -42,6 +43,7 @@ type MessageType int
 // - Snapshot request
 // - Heartbeat response
 // - ReadIndex response
+// - TimeoutNow request
 // - PreVote request
 // - Vote request
 //
@@ -72,6 +74,7 @@ const (
 	MsgUnreachable
 
 	MsgConfChange
+	MsgTimeoutNowRequest
 )
 
 type Message struct {
@@ -84,6 +87,12 @@ type Message struct {
 	Entries           []Entry
 	Snapshot          *Snapshot
 	Context           []byte
+
+	// Offset and Done are used by chunked snapshot transfer, Snapshot.Data
+	// of request is the chunk begins at Offset, and Done is true if it is the
+	// last chunk. Offset of response is the next offset expected by receiver.
+	Offset uint64
+	Done   bool
 }
 
 func (c *Message) Reset() { *c = Message{} }
@@ -103,14 +112,20 @@ var MessageTypeString = []string{
 	"ReadIndex response",
 	"Unreachable",
 	"Configuration change",
+	"TimeoutNow request",
 }
 
 func (tp MessageType) String() string {
 	return MessageTypeString[tp]
 }
 
+// ConfState describes the configuration of raft group. OutgoingNodes
+// are the voters of old configuration in joint consensus, it is empty
+// if raft group isn't in joint consensus.
 type ConfState struct {
-	Nodes []uint64
+	Nodes         []uint64
+	Learners      []uint64
+	OutgoingNodes []uint64
 }
 
 func (c *ConfState) Reset() { *c = ConfState{} }
@@ -121,12 +136,19 @@ const (
 	ConfChangeAddNode ConfChangeType = iota
 	ConfChangeRemoveNode
 	ConfChangeLearnerNode
+	ConfChangePromoteNode
+	ConfChangeEnterJoint
+	ConfChangeLeaveJoint
 )
 
+// ConfChange describes a configuration change. NodeID is used by single
+// node change, AddNodes & RemoveNodes are used by ConfChangeEnterJoint.
 type ConfChange struct {
-	ID         uint64
-	ChangeType ConfChangeType
-	NodeID     uint64
+	ID          uint64
+	ChangeType  ConfChangeType
+	NodeID      uint64
+	AddNodes    []uint64
+	RemoveNodes []uint64
 }
 
 func (c *ConfChange) Reset() { *c = ConfChange{} }
@@ -134,6 +156,10 @@ func (c *ConfChange) Reset() { *c = ConfChange{} }
 var ConfChangeString = []string{
 	"Config: Add node",
 	"Config: Remove node",
+	"Config: Add learner node",
+	"Config: Promote learner node",
+	"Config: Enter joint consensus",
+	"Config: Leave joint consensus",
 }
 
 func (t ConfChangeType) String() string {
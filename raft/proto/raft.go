@@ -50,9 +50,12 @@ func (e Entry) String() string {
 		e.Index, e.Term, e.Type, e.Data)
 }
 
+// SnapshotMetadata describes the last entry covered by snapshot,
+// and the configuration of raft group at that entry.
 type SnapshotMetadata struct {
-	Index uint64
-	Term  uint64
+	Index     uint64
+	Term      uint64
+	ConfState ConfState
 }
 
 func (e *SnapshotMetadata) Reset() { *e = SnapshotMetadata{} }
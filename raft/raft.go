@@ -1,6 +1,8 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -8,11 +10,28 @@ import (
 	"github.com/thinkermao/bior/raft/core"
 	"github.com/thinkermao/bior/raft/core/conf"
 	"github.com/thinkermao/bior/raft/proto"
-	"github.com/thinkermao/bior/utils"
 	"github.com/thinkermao/bior/utils/pd"
 )
 
-// Application is interface for state machine.
+// ErrStopped means raft has been stopped.
+var ErrStopped = errors.New("raft: stopped")
+
+const (
+	// recvQueueSize is the number of messages waiting to step.
+	recvQueueSize = 4096
+	// maxBatchEvents limits events handled before one Ready.
+	maxBatchEvents = 256
+)
+
+// Application is interface for state machine. Application could also
+// implement core.SnapshotStreamer to transfer snapshot data by stream.
+// Callbacks are called by the goroutine owns raft, so they must not
+// wait for methods of Raft. Committed entries are applied by another
+// goroutine in order, implement BatchApplication to apply them in batch.
+// ApplyEntry, ApplyEntries and SaveSnapshot are called by it, they could
+// call Kill, Stop, and methods which don't wait entries applied, such as
+// Write, proposals made by them aren't throttled.
+// Implement RoleApplication to be notified when leadership changes.
 type Application interface {
 	ApplyEntry(entry *raftpd.Entry)
 	ReadStateNotice(idx uint64, bytes []byte)
@@ -22,237 +41,636 @@ type Application interface {
 
 // Raft is a implements of raft consensus algorithm,
 // with log storage and periodic timer. Raft is thread-safty.
+//
+// A single goroutine owns raft core, it takes messages, proposals
+// and ticks from channels, and handles Ready as soon as there is
+// any work, so requests needn't wait for next tick.
 type Raft struct {
-	mutex sync.Mutex
-
 	id uint64
 
-	raft core.Raft
-	wal  *logStorage
-
-	timer     *utils.Timer
-	callback  Application
-	transport Transporter
+	raft    core.Raft
+	storage Storage
+	// hard state has been saved to storage.
+	hardState raftpd.HardState
+
+	recvc    chan raftpd.Message
+	actionc  chan func()
+	stopc    chan struct{}
+	donec    chan struct{}
+	stopOnce sync.Once
+	graceful bool  /* handle works in flight before exit */
+	fatal    error /* storage failure stopped raft */
+
+	callback   Application
+	transport  Transporter
+	applier    *applier
+	membership *membership
+	role       RoleChange /* role notified to application */
+	proposals  *proposalTracker
+	reads      *readTracker
+
+	// metrics fields.
+	metrics     Metrics
+	leader      uint64 /* leader reported to metrics */
+	lagReported bool   /* peer lags reported as leader */
 }
 
-// MakeRaft return a instance of Raft.
+// MakeRaft return a instance of Raft, storage must be empty.
+// Use StartRaft to start raft on wal, and restore application.
 func MakeRaft(
 	id uint64,
 	nodes []uint64,
 	electionTimeout, heartbeatTimeout, tickSize int,
 	maxSizePerMsg uint,
-	walDir string,
+	storage Storage,
 	application Application,
 	transport Transporter) (*Raft, error) {
-	raft := &Raft{id: id}
-	raft.callback = application
-	raft.transport = transport
-
-	config := conf.Config{
-		ID:            id,
-		Vote:          conf.InvalidID,
-		Term:          conf.InvalidTerm,
-		ElectionTick:  electionTimeout,
-		HeartbeatTick: heartbeatTimeout,
-		Nodes:         nodes,
-		Entries:       nil,
-		MaxSizePreMsg: maxSizePerMsg,
-	}
-
-	raft.raft = core.MakeRaft(&config, raft)
-
-	// apply a dummy snapshot for restore wal from disk.
-	// FIXME: should call first after raft build.
-	go raft.callback.ApplySnapshot(&raftpd.Snapshot{
-		Metadata: raftpd.SnapshotMetadata{
-			Index: conf.InvalidIndex,
-			Term:  conf.InvalidTerm,
-		},
-	})
-
-	w, err := CreateLogStorage(walDir, Metadata{
-		Index: conf.InvalidIndex,
-		Term:  conf.InvalidTerm,
-	})
-	if err != nil {
-		return nil, err
+	config := Config{
+		ID:               id,
+		Nodes:            nodes,
+		ElectionTimeout:  electionTimeout,
+		HeartbeatTimeout: heartbeatTimeout,
+		TickSize:         tickSize,
+		MaxSizePerMsg:    maxSizePerMsg,
+		Application:      application,
+		Transport:        transport,
 	}
-	raft.wal = w
-
-	raft.service(tickSize)
-
-	return raft, nil
+	state := raftpd.HardState{
+		Vote: conf.InvalidID,
+		Term: conf.InvalidTerm,
+	}
+	confState := raftpd.ConfState{Nodes: nodes}
+	return buildRaft(&config, storage, nil, state, conf.InvalidIndex, confState), nil
 }
 
-// RebuildRaft rebuild a instance of Raft.
+// RebuildRaft rebuild a instance of Raft from entries, hard state
+// and configuration loaded from storage, nodes is used only if no
+// configuration has been saved.
 func RebuildRaft(
 	id uint64,
-	meta Metadata,
 	nodes []uint64,
 	electionTimeout, heartbeatTimeout, tickSize int,
 	maxSizePerMsg uint,
-	walDir string,
+	storage Storage,
 	application Application,
 	transport Transporter) (*Raft, error) {
 
-	ls, entries, state, err := RestoreLogStorage(walDir, meta)
+	entries, state, err := storage.Load()
 	if err != nil {
 		return nil, err
 	}
+	confIndex, confState, err := storage.LoadConfState()
+	if err != nil {
+		return nil, err
+	}
+	if confIndex == conf.InvalidIndex {
+		confState = raftpd.ConfState{Nodes: nodes}
+	}
 
-	raft := &Raft{id: id}
-	raft.callback = application
-	raft.transport = transport
-	config := conf.Config{
-		ID:            id,
+	config := Config{
+		ID:               id,
+		Nodes:            nodes,
+		ElectionTimeout:  electionTimeout,
+		HeartbeatTimeout: heartbeatTimeout,
+		TickSize:         tickSize,
+		MaxSizePerMsg:    maxSizePerMsg,
+		Application:      application,
+		Transport:        transport,
+	}
+	return buildRaft(&config, storage, entries, state, confIndex, confState), nil
+}
+
+// buildRaft build raft from entries and hard state of storage, and
+// configuration applied at confIndex, and start it.
+func buildRaft(config *Config, storage Storage,
+	entries []raftpd.Entry, state raftpd.HardState,
+	confIndex uint64, confState raftpd.ConfState) *Raft {
+	raft := makeRaft(config.ID)
+	raft.callback = config.Application
+	raft.transport = config.Transport
+	raft.storage = storage
+	raft.hardState = state
+	raft.membership = makeMembership(confIndex, confState)
+	raft.applier.policy = config.Snapshot
+	if config.Metrics != nil {
+		raft.metrics = config.Metrics
+	}
+
+	c := conf.Config{
+		ID:            config.ID,
 		Vote:          state.Vote,
 		Term:          state.Term,
-		ElectionTick:  electionTimeout,
-		HeartbeatTick: heartbeatTimeout,
-		Nodes:         nodes,
+		ElectionTick:  config.ElectionTimeout,
+		HeartbeatTick: config.HeartbeatTimeout,
+		Nodes:         confState.Nodes,
+		Learners:      confState.Learners,
+		OutgoingNodes: confState.OutgoingNodes,
 		Entries:       entries,
-		MaxSizePreMsg: maxSizePerMsg,
+		MaxSizePreMsg: config.MaxSizePerMsg,
+
+		ReadOnlyOption: config.ReadOnlyOption,
 	}
-	raft.raft = core.MakeRaft(&config, raft)
-	raft.wal = ls
+	raft.raft = core.MakeRaft(&c, raft.nodeApplication())
+	raft.start(config.TickSize)
 
-	raft.service(tickSize)
+	return raft
+}
 
-	return raft, nil
+func makeRaft(id uint64) *Raft {
+	raft := &Raft{
+		id:         id,
+		recvc:      make(chan raftpd.Message, recvQueueSize),
+		actionc:    make(chan func()),
+		stopc:      make(chan struct{}),
+		donec:      make(chan struct{}),
+		proposals:  makeProposalTracker(),
+		reads:      makeReadTracker(),
+		membership: makeMembership(conf.InvalidIndex, raftpd.ConfState{}),
+		metrics:    nopMetrics{},
+		leader:     conf.InvalidID,
+		role:       RoleChange{Role: core.RoleFollower, LeaderID: conf.InvalidID},
+	}
+	raft.applier = makeApplier(raft)
+	return raft
+}
+
+// start run raft loop and applier.
+func (raft *Raft) start(tickSize int) {
+	go raft.applier.run()
+	go raft.run(tickSize)
 }
 
 // GetState return the state of raft.
-func (raft *Raft) GetState() (uint64, bool) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
+func (raft *Raft) GetState() (term uint64, isLeader bool) {
+	raft.do(func() {
+		term, isLeader = raft.raft.ReadStatus()
+	})
+	return
+}
 
-	return raft.raft.ReadStatus()
+// Status return a snapshot of raft status, including replication
+// progress of followers if it is leader. It returns zero Status
+// if raft has been stopped.
+func (raft *Raft) Status() (status core.Status) {
+	raft.do(func() {
+		status = raft.raft.Status()
+	})
+	return
 }
 
-// Kill is the only one global method no need mutex.
+// Kill stop raft immediately, and wait it exit. Entries committed
+// but not applied are dropped. Application callbacks would not be
+// called after Kill return. It could be called by ApplyEntry,
+// ApplyEntries and SaveSnapshot, but not other callbacks.
 func (raft *Raft) Kill() {
-	raft.timer.Stop()
-	raft.wal.close()
+	if raft.applier.onApplier() {
+		raft.applier.leave()
+	}
+	raft.stopOnce.Do(func() {
+		close(raft.stopc)
+	})
+	<-raft.donec
+}
+
+// Stop stop raft gracefully, Ready in flight is saved and sent, and
+// committed entries are applied, then pending proposals and reads
+// fail with ErrStopped. If ctx is done before that, it stops
+// immediately like Kill, and return ctx.Err(). Called by callbacks
+// on applier, it stops like Kill, entries couldn't be applied until
+// callback returns.
+func (raft *Raft) Stop(ctx context.Context) error {
+	if raft.applier.onApplier() {
+		raft.Kill()
+		return nil
+	}
+	raft.stopOnce.Do(func() {
+		raft.graceful = true
+		close(raft.stopc)
+	})
+
+	select {
+	case <-raft.donec:
+		return nil
+	case <-ctx.Done():
+		raft.applier.stop()
+		<-raft.donec
+		return ctx.Err()
+	}
+}
+
+// Done return a channel closed after raft stopped, by Kill,
+// Stop, or storage failure.
+func (raft *Raft) Done() <-chan struct{} {
+	return raft.donec
+}
+
+// Err return the storage failure stopped raft, it returns
+// nil if raft is running or stopped by Kill or Stop.
+func (raft *Raft) Err() error {
+	select {
+	case <-raft.donec:
+		return raft.fatal
+	default:
+		return nil
+	}
 }
 
 // Read operate not sync disk
-func (raft *Raft) Read(bytes []byte) bool {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
+func (raft *Raft) Read(bytes []byte) (ok bool) {
+	raft.do(func() {
+		ok = raft.raft.Read(bytes)
+	})
+	return
+}
 
-	return raft.raft.Read(bytes)
+// Write write operate will sync disk. Use Propose or ProposeWait
+// to know whether entry is applied.
+func (raft *Raft) Write(bytes []byte) (index uint64, term uint64, isLeader bool) {
+	raft.applier.throttle()
+	raft.do(func() {
+		index, term, isLeader = raft.raft.Propose(bytes)
+		raft.proposed(isLeader)
+	})
+	return
 }
 
-// Write write operate will sync disk.
-func (raft *Raft) Write(bytes []byte) (uint64, uint64, bool) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
+// ProposeConfChange propose configuration change, such as add learner,
+// promote learner to voter, or enter joint consensus to replace multiple
+// voters at once. Change will be applied after committed. It is
+// rejected if the last conf change proposed hasn't been applied.
+func (raft *Raft) ProposeConfChange(cc *raftpd.ConfChange) (index uint64, term uint64, isLeader bool) {
+	raft.applier.throttle()
+	raft.do(func() {
+		index, term, isLeader = raft.raft.ProposeConfChange(cc)
+		raft.proposed(isLeader)
+	})
+	return
+}
 
-	return raft.raft.Propose(bytes)
+// TransferLeader try to transfer leadership to transferee, proposals
+// will be dropped until transfer finished or aborted.
+func (raft *Raft) TransferLeader(transferee uint64) {
+	raft.do(func() {
+		raft.raft.TransferLeader(transferee)
+	})
 }
 
-// Compact notice
+// Compact discard entries before snapshot saved by application,
+// SnapshotPolicy could be used to take snapshot and compact log
+// automatically instead.
 func (raft *Raft) Compact(snapshot *raftpd.Snapshot) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
+	raft.applier.snapshotTaken(snapshot.Metadata.Index)
+	raft.do(func() {
+		raft.raft.ApplySnapshot(&snapshot.Metadata)
+		raft.membership.compact(snapshot.Metadata.Index)
+		if err := raft.storage.Compact(Metadata{
+			Index: snapshot.Metadata.Index,
+			Term:  snapshot.Metadata.Term,
+		}); err != nil {
+			raft.fail(err)
+		}
+	})
+}
+
+// do run action at the goroutine owns raft core, and wait it finished.
+// It returns false without running action if raft has been stopped.
+func (raft *Raft) do(action func()) bool {
+	done := make(chan struct{})
+	if !raft.post(func() {
+		action()
+		close(done)
+	}) {
+		return false
+	}
 
-	raft.raft.ApplySnapshot(&snapshot.Metadata)
+	select {
+	case <-done:
+		return true
+	case <-raft.donec:
+		// action might have run before raft stopped.
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
 }
 
-func (raft *Raft) ready() (rd core.Ready) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
-	rd = raft.raft.Ready()
-	return
+// post send action to the goroutine owns raft core without waiting
+// it finished. It returns false if raft has been stopped.
+func (raft *Raft) post(action func()) bool {
+	select {
+	case raft.actionc <- action:
+		return true
+	case <-raft.stopc:
+		return false
+	}
 }
 
-func (raft *Raft) handleRaftReady() {
-	ready := raft.ready()
-	// FIXME: 在save之前可以先处理 readStateNotice
-	if err := raft.wal.save(ready.SS.LastIndex, ready.HS, ready.Entries); err != nil {
-		panic(err)
+// run is the loop owns raft core, it handles one event, drains events
+// queued, and then handles Ready if there is any work.
+func (raft *Raft) run(tickSize int) {
+	defer raft.terminate()
+
+	ticker := time.NewTicker(time.Duration(tickSize) * time.Millisecond)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			// FIXME: Adjust time, because handle ready cost.
+			millsSinceLastPeriod := int(now.Sub(last).Nanoseconds() / 1000000)
+			last = now
+			raft.raft.Periodic(millsSinceLastPeriod)
+			raft.observePeers()
+		case msg := <-raft.recvc:
+			raft.raft.Step(&msg)
+		case action := <-raft.actionc:
+			action()
+		case <-raft.applier.appliedc:
+			applied := raft.applier.appliedIndex()
+			raft.raft.AppliedTo(applied)
+			raft.metrics.SetAppliedIndex(applied)
+			if index := raft.applier.takeSnapshotIndex(); index != 0 {
+				raft.compact(index)
+			}
+		case <-raft.stopc:
+			if raft.graceful {
+				raft.drain()
+				raft.handleReadies()
+			}
+			return
+		}
+
+		raft.drain()
+		raft.handleReadies()
+		if raft.fatal != nil {
+			return
+		}
 	}
-	if err := raft.wal.sync(); err != nil {
-		panic(err)
+}
+
+// handleReadies handle Ready until there is no work, because entries
+// stabled by ready might be committed and applied.
+func (raft *Raft) handleReadies() {
+	for raft.fatal == nil && raft.raft.HasReady() {
+		raft.handleRaftReady()
+	}
+}
+
+// fail stop raft because of storage failure.
+func (raft *Raft) fail(err error) {
+	log.Errorf("%d stop because of storage failure: %v", raft.id, err)
+	if raft.fatal == nil {
+		raft.fatal = err
+	}
+}
+
+// terminate release resources after raft loop exit, pending
+// proposals and reads fail with the reason of exit.
+func (raft *Raft) terminate() {
+	raft.stopOnce.Do(func() {
+		close(raft.stopc)
+	})
+
+	if raft.graceful && raft.fatal == nil {
+		raft.applier.flush()
+	}
+	raft.applier.stop()
+
+	err := raft.fatal
+	if err == nil {
+		err = ErrStopped
 	}
+	raft.proposals.failAll(err)
+	raft.reads.failAll(err)
 
-	for i := 0; i < len(ready.CommitEntries); i++ {
-		entry := &ready.CommitEntries[i]
-		if entry.Type == raftpd.EntryNormal {
-			raft.callback.ApplyEntry(entry)
+	if err := raft.storage.Close(); err != nil {
+		log.Warnf("%d close storage: %v", raft.id, err)
+	}
+	close(raft.donec)
+}
+
+// drain handle events queued without blocking, so that
+// they are persisted and sent by one Ready.
+func (raft *Raft) drain() {
+	for i := 0; i < maxBatchEvents; i++ {
+		select {
+		case msg := <-raft.recvc:
+			raft.raft.Step(&msg)
+		case action := <-raft.actionc:
+			action()
+		default:
+			return
 		}
 	}
+}
+
+func (raft *Raft) handleRaftReady() {
+	ready := raft.raft.Ready()
+	term, _ := raft.raft.ReadStatus()
+	raft.observeReady(&ready)
+
+	// leader sends entries to followers while saving them, it will
+	// count itself after entries are stabled. But term and vote must
+	// be saved before any message sent at new term.
+	messages := ready.Messages
+	if ready.SS != nil && ready.SS.State.IsLeader() &&
+		(ready.HS == nil || (ready.HS.Term == raft.hardState.Term &&
+			ready.HS.Vote == raft.hardState.Vote)) {
+		messages = raft.sendAppendRequests(messages)
+	}
+
+	// FIXME: 在save之前可以先处理 readStateNotice
+	if err := raft.save(&ready); err != nil {
+		// messages depend on entries and hard state
+		// must not be sent, because they are lost.
+		raft.fail(err)
+		return
+	}
+	raft.raft.Advance(ready)
 
 	if len(ready.CommitEntries) > 0 {
 		last := len(ready.CommitEntries) - 1
-		log.Debugf("%d apply entries from %d [term: %d] to %d [term: %d]",
+		log.Debugf("%d commit entries from %d [term: %d] to %d [term: %d]",
 			raft.id, ready.CommitEntries[0].Index, ready.CommitEntries[last].Term,
 			ready.CommitEntries[last].Index, ready.CommitEntries[last].Term)
 	}
 
-	raft.mutex.Lock()
-	for i := 0; i < len(ready.CommitEntries); i++ {
-		if ready.CommitEntries[i].Type == raftpd.EntryConfChange {
-			cc := raftpd.ConfChange{}
-			pd.MustUnmarshal(&cc, ready.CommitEntries[i].Data)
-			raft.raft.ApplyConfChange(&cc)
-		}
+	// configurations must be recorded before entries are applied,
+	// so that snapshot taken by applier is stamped by them.
+	if err := raft.applyConfChanges(ready.CommitEntries); err != nil {
+		raft.fail(err)
+		return
+	}
+
+	task := applyTask{entries: ready.CommitEntries}
+	// proposals before term are taken over by other leader now.
+	if ready.SS != nil && !ready.SS.State.IsLeader() {
+		task.lostTerm = term
 	}
-	raft.mutex.Unlock()
+	raft.applier.push(task)
 
+	if ready.SS != nil {
+		raft.reads.leaderChanged(ready.SS.LeaderID)
+	}
+	raft.notifyRoleChange(ready.SS, term)
 	for i := 0; i < len(ready.ReadStates); i++ {
+		if raft.reads.readState(&ready.ReadStates[i]) {
+			continue
+		}
 		raft.callback.ReadStateNotice(ready.ReadStates[i].Index,
 			ready.ReadStates[i].RequestCtx)
 	}
 
-	// send messages accumulation at raft.msg
-	for i := 0; i < len(ready.Messages); i++ {
-		raftMsg := &ready.Messages[i]
-		if err := raft.transport.Send(raftMsg.To, raftMsg); err != nil {
-			raft.Unreachable(raftMsg.To)
+	raft.sendMessages(messages)
+}
+
+// applyConfChanges apply conf changes committed, and save configuration,
+// conf changes already contained by configuration restored are skipped.
+func (raft *Raft) applyConfChanges(entries []raftpd.Entry) error {
+	for i := 0; i < len(entries); i++ {
+		entry := &entries[i]
+		if entry.Type != raftpd.EntryConfChange ||
+			entry.Index <= raft.membership.lastIndex() {
+			continue
+		}
+
+		cc := raftpd.ConfChange{}
+		pd.MustUnmarshal(&cc, entry.Data)
+		state := raft.raft.ApplyConfChange(&cc)
+		raft.membership.add(entry.Index, state)
+		if err := raft.storage.SaveConfState(entry.Index, &state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreConfState save configuration of snapshot restored, snapshot
+// built without configuration keeps current one.
+func (raft *Raft) restoreConfState(metadata *raftpd.SnapshotMetadata) {
+	if len(metadata.ConfState.Nodes) == 0 {
+		return
+	}
+	raft.membership.reset(metadata.Index, metadata.ConfState)
+	if err := raft.storage.SaveConfState(metadata.Index, &metadata.ConfState); err != nil {
+		raft.fail(err)
+	}
+}
+
+// save entries and hard state of ready to stable storage.
+func (raft *Raft) save(ready *core.Ready) error {
+	start := time.Now()
+	if err := raft.storage.SaveEntries(ready.Entries); err != nil {
+		return err
+	}
+	if ready.HS != nil {
+		if err := raft.storage.SaveHardState(ready.HS); err != nil {
+			return err
 		}
+		raft.hardState = *ready.HS
+	}
+	raft.metrics.ObserveSave(time.Since(start))
+
+	start = time.Now()
+	if err := raft.storage.Sync(); err != nil {
+		return err
 	}
+	raft.metrics.ObserveSync(time.Since(start))
+	return nil
 }
 
-// service create tick per 100 milliseconds,
-// when tick, call periodic and handleRaftReady()
-func (raft *Raft) service(tickSize int) {
-	last := time.Now()
-	raft.timer = utils.StartTimer(tickSize, func(time time.Time) {
-		// FIXME: Adjust time, because lock cost.
-		nanoseconds := time.Sub(last).Nanoseconds()
-		last = time
+// sendAppendRequests send append requests, and return others.
+func (raft *Raft) sendAppendRequests(messages []raftpd.Message) []raftpd.Message {
+	var others []raftpd.Message
+	for i := 0; i < len(messages); i++ {
+		if messages[i].MsgType == raftpd.MsgAppendRequest {
+			raft.sendMessages(messages[i : i+1])
+		} else {
+			others = append(others, messages[i])
+		}
+	}
+	return others
+}
 
-		var millsSinceLastPeriod = int(nanoseconds / 1000000)
-		raft.periodic(millsSinceLastPeriod)
-		raft.handleRaftReady()
-	})
+func (raft *Raft) sendMessages(messages []raftpd.Message) {
+	for i := 0; i < len(messages); i++ {
+		raftMsg := &messages[i]
+		err := raft.transport.Send(raftMsg.To, raftMsg)
+		if err == nil {
+			if raftMsg.MsgType == raftpd.MsgSnapshotRequest && raftMsg.Offset == 0 {
+				raft.metrics.SnapshotSent(raftMsg.To)
+			}
+			continue
+		}
+		// finish of snapshot is known by response of remote, because
+		// transport may send message asynchronously.
+		if raftMsg.MsgType == raftpd.MsgSnapshotRequest {
+			raft.raft.ReportSnapshot(raftMsg.To, core.SnapshotFailure)
+		} else {
+			raft.raft.Unreachable(raftMsg.To)
+		}
+	}
+}
+
+// streamRaft forwards snapshot stream of Application to raft core.
+type streamRaft struct {
+	*Raft
+	core.SnapshotStreamer
 }
 
-func (raft *Raft) periodic(millsSinceLastPeriod int) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
-	raft.raft.Periodic(millsSinceLastPeriod)
+// RestoreSnapshot restore state machine by streamer, and
+// advance apply index of raft.
+func (r streamRaft) RestoreSnapshot(metadata *raftpd.SnapshotMetadata) {
+	r.applier.flush()
+	r.SnapshotStreamer.RestoreSnapshot(metadata)
+	r.applier.appliedTo(metadata)
+	r.restoreConfState(metadata)
 }
 
+// nodeApplication return the application used by raft core.
+func (raft *Raft) nodeApplication() core.NodeApplication {
+	if streamer, ok := raft.callback.(core.SnapshotStreamer); ok {
+		return streamRaft{raft, streamer}
+	}
+	return raft
+}
+
+// ApplySnapshot restore state machine after entries
+// queued have been applied.
 func (raft *Raft) ApplySnapshot(snapshot *raftpd.Snapshot) {
+	raft.applier.flush()
 	raft.callback.ApplySnapshot(snapshot)
+	raft.applier.appliedTo(&snapshot.Metadata)
+	raft.restoreConfState(&snapshot.Metadata)
 }
 
 func (raft *Raft) ReadSnapshot() *raftpd.Snapshot {
 	return raft.callback.ReadSnapshot()
 }
 
+// Step queue message received from remote, it is dropped
+// if raft has been killed.
 func (raft *Raft) Step(msg *raftpd.Message) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
-
-	raft.raft.Step(msg)
+	select {
+	case raft.recvc <- *msg:
+	case <-raft.stopc:
+	}
 }
 
+// Unreachable report that message could not be sent to peer.
 func (raft *Raft) Unreachable(peer uint64) {
-	raft.mutex.Lock()
-	defer raft.mutex.Unlock()
+	raft.post(func() {
+		raft.raft.Unreachable(peer)
+	})
+}
 
-	raft.raft.Unreachable(peer)
+// ReportSnapshot report the result of snapshot sending to peer.
+func (raft *Raft) ReportSnapshot(peer uint64, status core.SnapshotStatus) {
+	raft.post(func() {
+		raft.raft.ReportSnapshot(peer, status)
+	})
 }
@@ -0,0 +1,225 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+var errSync = errors.New("sync failed")
+
+// failStorage fails to sync entries since the one carries failData,
+// so that failure isn't triggered by other Ready in flight.
+type failStorage struct {
+	*MemoryStorage
+	fail int32
+}
+
+var failData = []byte("fail")
+
+func (s *failStorage) SaveEntries(entries []raftpd.Entry) error {
+	for i := 0; i < len(entries); i++ {
+		if bytes.Equal(entries[i].Data, failData) {
+			atomic.StoreInt32(&s.fail, 1)
+		}
+	}
+	return s.MemoryStorage.SaveEntries(entries)
+}
+
+func (s *failStorage) Sync() error {
+	if atomic.LoadInt32(&s.fail) != 0 {
+		return errSync
+	}
+	return s.MemoryStorage.Sync()
+}
+
+func makeSingletonRaft(t *testing.T, storage Storage, app Application) *Raft {
+	raft, err := MakeRaft(1, []uint64{1}, 50, 10, 5, 1024*1024,
+		storage, app, nopTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, err := raft.ProposeWait(ctx, nil)
+		if err == nil {
+			return raft
+		} else if err != ErrNotLeader {
+			t.Fatalf("propose wait: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaft_Stop(t *testing.T) {
+	raft := makeSingletonRaft(t, MakeMemoryStorage(Metadata{}), &nopApplication{})
+
+	futures := []*Future{}
+	for i := 0; i < 10; i++ {
+		future, err := raft.Propose([]byte("data"))
+		if err != nil {
+			t.Fatalf("#%d: propose: %v", i, err)
+		}
+		futures = append(futures, future)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := raft.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	/* proposals in flight are applied before stop */
+	for i, future := range futures {
+		select {
+		case <-future.Done():
+		default:
+			t.Fatalf("#%d: proposal should be resolved after stop", i)
+		}
+		if future.Err() != nil {
+			t.Fatalf("#%d: proposal want applied, get: %v", i, future.Err())
+		}
+	}
+	if raft.Err() != nil {
+		t.Fatalf("stopped raft should not report error, get: %v", raft.Err())
+	}
+	if _, err := raft.Propose([]byte("data")); err != ErrStopped {
+		t.Fatalf("propose after stop want: %v, get: %v", ErrStopped, err)
+	}
+	if err := raft.ReadIndex(ctx); err != ErrStopped {
+		t.Fatalf("read index after stop want: %v, get: %v", ErrStopped, err)
+	}
+}
+
+func TestRaft_StorageFailure(t *testing.T) {
+	storage := &failStorage{MemoryStorage: MakeMemoryStorage(Metadata{})}
+	raft := makeSingletonRaft(t, storage, &nopApplication{})
+	defer raft.Kill()
+
+	future, err := raft.Propose(failData)
+	if err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+
+	select {
+	case <-raft.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("raft should stop after storage failure")
+	}
+	if raft.Err() != errSync {
+		t.Fatalf("err want: %v, get: %v", errSync, raft.Err())
+	}
+	<-future.Done()
+	if future.Err() != errSync {
+		t.Fatalf("proposal err want: %v, get: %v", errSync, future.Err())
+	}
+}
+
+func TestRaft_Status(t *testing.T) {
+	raft := makeSingletonRaft(t, MakeMemoryStorage(Metadata{}), &nopApplication{})
+
+	status := raft.Status()
+	if !status.State.IsLeader() || status.Applied == 0 || status.Applied != status.Commit {
+		t.Fatalf("status want applied leader, get: %+v", status)
+	}
+
+	raft.Kill()
+	if status := raft.Status(); status.ID != 0 {
+		t.Fatalf("stopped raft should return zero status, get: %+v", status)
+	}
+}
+
+var killData = []byte("kill")
+
+// killApplication stops raft when entry carries killData is applied,
+// and counts entries applied after that.
+type killApplication struct {
+	nopApplication
+	raft   *Raft
+	stop   bool
+	killed int32
+	after  int32
+}
+
+func (app *killApplication) ApplyEntry(entry *raftpd.Entry) {
+	if atomic.LoadInt32(&app.killed) != 0 {
+		atomic.AddInt32(&app.after, 1)
+		return
+	}
+	if !bytes.Equal(entry.Data, killData) {
+		return
+	}
+	if app.stop {
+		app.raft.Stop(context.Background())
+	} else {
+		app.raft.Kill()
+	}
+	atomic.StoreInt32(&app.killed, 1)
+}
+
+// TestRaft_KillByCallback ensures that raft could be stopped by
+// callback on applier, and no entry is applied after that.
+func TestRaft_KillByCallback(t *testing.T) {
+	tests := []struct {
+		stop bool
+	}{
+		{false},
+		{true},
+	}
+
+	for i, test := range tests {
+		app := &killApplication{stop: test.stop}
+		raft := makeSingletonRaft(t, MakeMemoryStorage(Metadata{}), app)
+		app.raft = raft
+
+		if _, err := raft.Propose(killData); err != nil {
+			t.Fatalf("#%d propose: %v", i, err)
+		}
+		for j := 0; j < 10; j++ {
+			raft.Propose([]byte("data"))
+		}
+
+		select {
+		case <-raft.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d raft should stop by callback", i)
+		}
+		raft.Kill()
+		/* applier exits after callback returns */
+		<-raft.applier.donec
+		if atomic.LoadInt32(&app.killed) == 0 {
+			t.Fatalf("#%d kill should return to callback", i)
+		}
+		if after := atomic.LoadInt32(&app.after); after != 0 {
+			t.Fatalf("#%d entries applied after kill want: 0, get: %d", i, after)
+		}
+	}
+}
+
+func TestApplier_ThrottleCallback(t *testing.T) {
+	a := makeApplier(makeRaft(1))
+	a.pending = maxApplyPending
+
+	done := make(chan struct{})
+	go func() {
+		/* proposal by callback on applier isn't throttled */
+		a.mutex.Lock()
+		a.goid = goroutineID()
+		a.mutex.Unlock()
+		a.throttle()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("callback should not be throttled")
+	}
+}
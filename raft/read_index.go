@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thinkermao/bior/raft/core/read"
+)
+
+var (
+	// ErrLeaderChanged means leader changed before read index confirmed.
+	ErrLeaderChanged = errors.New("raft: leader changed before read index confirmed")
+	// ErrNoLeader means there is no leader to serve read index.
+	ErrNoLeader = errors.New("raft: no leader")
+)
+
+// readContextPrefix distinguishes request context generated by ReadIndex
+// from contexts given by Read, those are still sent to ReadStateNotice.
+var readContextPrefix = []byte("bior/read-index/")
+
+type readRequest struct {
+	leader  uint64
+	index   uint64
+	waiting bool /* waiting apply index reach index */
+	done    chan error
+}
+
+// readTracker holds read requests until read state received,
+// and apply index reach read index.
+type readTracker struct {
+	mutex    sync.Mutex
+	seq      uint64
+	applied  uint64
+	requests map[string]*readRequest
+}
+
+func makeReadTracker() *readTracker {
+	return &readTracker{
+		requests: make(map[string]*readRequest),
+	}
+}
+
+// register create request with unique context.
+func (t *readTracker) register(id, leader uint64) ([]byte, *readRequest) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.seq++
+	ctx := make([]byte, len(readContextPrefix)+16)
+	copy(ctx, readContextPrefix)
+	binary.BigEndian.PutUint64(ctx[len(readContextPrefix):], id)
+	binary.BigEndian.PutUint64(ctx[len(readContextPrefix)+8:], t.seq)
+
+	req := &readRequest{leader: leader, done: make(chan error, 1)}
+	t.requests[string(ctx)] = req
+	return ctx, req
+}
+
+func (t *readTracker) cancel(ctx []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.requests, string(ctx))
+}
+
+// readState record read index of request, return false
+// if state isn't belong to ReadIndex.
+func (t *readTracker) readState(state *read.ReadState) bool {
+	if !bytes.HasPrefix(state.RequestCtx, readContextPrefix) {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	req, ok := t.requests[string(state.RequestCtx)]
+	if !ok || req.waiting {
+		return true
+	}
+	req.index = state.Index
+	req.waiting = true
+	if req.index <= t.applied {
+		t.finish(string(state.RequestCtx), nil)
+	}
+	return true
+}
+
+// appliedTo advance apply index, and finish requests whose
+// read index has been applied.
+func (t *readTracker) appliedTo(index uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if index <= t.applied {
+		return
+	}
+	t.applied = index
+	for ctx, req := range t.requests {
+		if req.waiting && req.index <= index {
+			t.finish(ctx, nil)
+		}
+	}
+}
+
+// leaderChanged fail requests not confirmed by leader.
+func (t *readTracker) leaderChanged(leader uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for ctx, req := range t.requests {
+		if !req.waiting && req.leader != leader {
+			t.finish(ctx, ErrLeaderChanged)
+		}
+	}
+}
+
+// failAll fail all requests with err.
+func (t *readTracker) failAll(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for ctx := range t.requests {
+		t.finish(ctx, err)
+	}
+}
+
+func (t *readTracker) finish(ctx string, err error) {
+	req := t.requests[ctx]
+	delete(t.requests, ctx)
+	req.done <- err
+}
+
+// ReadIndex wait until it is safe to serve linearizable read locally,
+// that is, leader confirmed its commit index as read index, and local
+// apply index has reached it. It return ErrNoLeader or ErrLeaderChanged
+// if leader is unavailable, or ctx.Err() if ctx is done before that.
+func (raft *Raft) ReadIndex(ctx context.Context) error {
+	start := time.Now()
+	var reqCtx []byte
+	var req *readRequest
+	if !raft.do(func() {
+		leader := raft.raft.ReadSoftState().LeaderID
+		reqCtx, req = raft.reads.register(raft.id, leader)
+		if !raft.raft.Read(reqCtx) {
+			raft.reads.cancel(reqCtx)
+			req = nil
+		}
+	}) {
+		return ErrStopped
+	}
+	if req == nil {
+		return ErrNoLeader
+	}
+
+	select {
+	case err := <-req.done:
+		if err == nil {
+			raft.metrics.ObserveReadIndex(time.Since(start))
+		}
+		return err
+	case <-ctx.Done():
+		raft.reads.cancel(reqCtx)
+		return ctx.Err()
+	}
+}
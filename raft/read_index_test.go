@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/core/read"
+)
+
+func readDone(req *readRequest) (error, bool) {
+	select {
+	case err := <-req.done:
+		return err, true
+	default:
+		return nil, false
+	}
+}
+
+func TestReadTracker(t *testing.T) {
+	tests := []struct {
+		applied uint64 /* apply index before read state */
+		index   uint64
+		leader  uint64 /* leader changed to after read state if non zero */
+		applyTo uint64
+		done    bool
+		wantErr error
+	}{
+		{5, 5, 0, 0, true, nil},
+		{4, 5, 0, 0, false, nil},
+		{4, 5, 0, 5, true, nil},
+		/* confirmed read state isn't affected by leader change */
+		{4, 5, 2, 0, false, nil},
+	}
+
+	for i, test := range tests {
+		tracker := makeReadTracker()
+		tracker.appliedTo(test.applied)
+		ctx, req := tracker.register(1, 1)
+		tracker.readState(&read.ReadState{Index: test.index, RequestCtx: ctx})
+		if test.leader != 0 {
+			tracker.leaderChanged(test.leader)
+		}
+		tracker.appliedTo(test.applyTo)
+
+		err, done := readDone(req)
+		if done != test.done || err != test.wantErr {
+			t.Fatalf("#%d: want: [done: %v, err: %v], get: [done: %v, err: %v]",
+				i, test.done, test.wantErr, done, err)
+		}
+	}
+}
+
+func TestReadTracker_LeaderChanged(t *testing.T) {
+	tracker := makeReadTracker()
+	ctx, req := tracker.register(1, 2)
+	tracker.leaderChanged(2)
+	if _, done := readDone(req); done {
+		t.Fatalf("request should wait if leader isn't changed")
+	}
+	tracker.leaderChanged(3)
+	if err, _ := readDone(req); err != ErrLeaderChanged {
+		t.Fatalf("want: %v, get: %v", ErrLeaderChanged, err)
+	}
+
+	/* read state of other contexts are left to application */
+	if tracker.readState(&read.ReadState{RequestCtx: []byte("user")}) {
+		t.Fatalf("read state of user context should not be consumed")
+	}
+	if !tracker.readState(&read.ReadState{RequestCtx: ctx}) {
+		t.Fatalf("read state of read index should be consumed")
+	}
+}
+
+func TestRaft_ReadIndex(t *testing.T) {
+	app := &nopApplication{}
+	raft, err := MakeRaft(1, []uint64{1}, 50, 10, 5, 1024*1024,
+		MakeMemoryStorage(Metadata{}), app, nopTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var index uint64
+	for {
+		index, err = raft.ProposeWait(ctx, []byte("hello"))
+		if err != ErrNotLeader {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("propose wait: %v", err)
+	}
+
+	if err := raft.ReadIndex(ctx); err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	raft.reads.mutex.Lock()
+	defer raft.reads.mutex.Unlock()
+	if raft.reads.applied < index {
+		t.Fatalf("apply index want >= %d, get: %d", index, raft.reads.applied)
+	}
+}
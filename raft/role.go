@@ -0,0 +1,38 @@
+package raft
+
+import (
+	"github.com/thinkermao/bior/raft/core"
+)
+
+// RoleChange is the role of local node and the leader it knows at term.
+type RoleChange struct {
+	Role     core.StateRole
+	Term     uint64
+	LeaderID uint64 /* conf.InvalidID if leader is unknown */
+}
+
+// RoleApplication could be implemented by Application to be notified
+// when role of local node or leader changes, such as to start or stop
+// jobs only run on leader. RoleChanged is called by the goroutine owns
+// raft after term and vote saved, in order of changes, so it must not
+// wait for methods of Raft. It isn't called when raft stops, use Done
+// to know that.
+type RoleApplication interface {
+	RoleChanged(change RoleChange)
+}
+
+// notifyRoleChange notify application if role or leader
+// of soft state differs from the one notified last time.
+func (raft *Raft) notifyRoleChange(ss *core.SoftState, term uint64) {
+	if ss == nil || (ss.State == raft.role.Role && ss.LeaderID == raft.role.LeaderID) {
+		return
+	}
+	raft.role = RoleChange{
+		Role:     ss.State,
+		Term:     term,
+		LeaderID: ss.LeaderID,
+	}
+	if app, ok := raft.callback.(RoleApplication); ok {
+		app.RoleChanged(raft.role)
+	}
+}
@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/core"
+	"github.com/thinkermao/bior/raft/core/conf"
+)
+
+type roleApplication struct {
+	nopApplication
+	mutex   sync.Mutex
+	changes []RoleChange
+}
+
+func (app *roleApplication) RoleChanged(change RoleChange) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.changes = append(app.changes, change)
+}
+
+func (app *roleApplication) lastChange() (RoleChange, int) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if len(app.changes) == 0 {
+		return RoleChange{}, 0
+	}
+	return app.changes[len(app.changes)-1], len(app.changes)
+}
+
+func TestRaft_NotifyRoleChange(t *testing.T) {
+	tests := []struct {
+		ss     *core.SoftState
+		term   uint64
+		notify bool
+	}{
+		{nil, 1, false},
+		{&core.SoftState{State: core.RoleFollower, LeaderID: conf.InvalidID}, 1, false},
+		{&core.SoftState{State: core.RoleCandidate, LeaderID: conf.InvalidID}, 2, true},
+		{&core.SoftState{State: core.RoleCandidate, LeaderID: conf.InvalidID, LastIndex: 3}, 2, false},
+		{&core.SoftState{State: core.RoleLeader, LeaderID: 1}, 2, true},
+		{&core.SoftState{State: core.RoleFollower, LeaderID: conf.InvalidID}, 3, true},
+		{&core.SoftState{State: core.RoleFollower, LeaderID: 2}, 3, true},
+	}
+
+	app := &roleApplication{}
+	raft := makeRaft(1)
+	raft.callback = app
+	count := 0
+	for i, test := range tests {
+		raft.notifyRoleChange(test.ss, test.term)
+		change, n := app.lastChange()
+		if (n > count) != test.notify {
+			t.Fatalf("#%d: notify want: %v, get: %v", i, test.notify, n > count)
+		}
+		count = n
+		if !test.notify {
+			continue
+		}
+		want := RoleChange{Role: test.ss.State, Term: test.term, LeaderID: test.ss.LeaderID}
+		if change != want {
+			t.Fatalf("#%d: change want: %+v, get: %+v", i, want, change)
+		}
+	}
+}
+
+func TestRaft_RoleChanged(t *testing.T) {
+	app := &roleApplication{}
+	raft, err := MakeRaft(1, []uint64{1}, 50, 10, 5, 1024*1024,
+		MakeMemoryStorage(Metadata{}), app, nopTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		change, _ := app.lastChange()
+		if change.Role.IsLeader() {
+			term, _ := raft.GetState()
+			if change.LeaderID != 1 || change.Term != term {
+				t.Fatalf("change want leader 1 at term %d, get: %+v", term, change)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("singleton raft should notify it becomes leader")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Package snap provides an on-disk store of raft snapshots.
+//
+// Each snapshot is a file under dir named by its index and term.
+// File begins with a header, which has a magic, a CRC32 of the rest
+// of file, and the metadata of snapshot (index, term, conf state),
+// then follows snapshot data. File is written to a temporary file
+// and renamed after synced, so a crash never leaves partial snapshot.
+// Only the latest N snapshots are kept.
+//
+// Usage:
+//
+//	store, err := snap.MakeStore(dir, 3)
+//	...
+//
+//	func (app *application) ReadSnapshot() *raftpd.Snapshot {
+//		return app.store.ReadSnapshot()
+//	}
+//
+//	func (app *application) ApplySnapshot(snapshot *raftpd.Snapshot) {
+//		app.store.ApplySnapshot(snapshot)
+//		/* restore state machine */
+//	}
+//
+//	go func() {
+//		<-store.Done()
+//		log.Errorf("snapshot store failed: %v", store.Err())
+//		raft.Kill()
+//	}()
+package snap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+)
+
+const (
+	snapSuffix = ".snap"
+	tmpSuffix  = ".tmp"
+	// headerSize is size of magic and checksum.
+	headerSize = 8
+)
+
+var snapMagic = []byte("bsnp")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrNoSnapshot means there is no valid snapshot in store.
+	ErrNoSnapshot = errors.New("snap: no available snapshot")
+	// ErrCRCMismatch means snapshot file is corrupted.
+	ErrCRCMismatch = errors.New("snap: crc mismatch")
+	// ErrBadFormat means file isn't a snapshot.
+	ErrBadFormat = errors.New("snap: bad format")
+)
+
+// Store saves snapshots to files under dir, and keeps the latest
+// `retain` of them. Store is thread-safe.
+type Store struct {
+	mutex  sync.Mutex
+	dir    string
+	retain int
+
+	// latest snapshot saved or loaded, nil if there is none.
+	latest *raftpd.Snapshot
+
+	// donec is closed when ApplySnapshot fails, failure is the error.
+	donec   chan struct{}
+	failure error
+}
+
+// MakeStore open store at dir, it creates dir if not exists,
+// removes temporary files left by crash, and loads the newest
+// valid snapshot. At least one snapshot is kept.
+func MakeStore(dir string, retain int) (*Store, error) {
+	if retain < 1 {
+		retain = 1
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:    dir,
+		retain: retain,
+		donec:  make(chan struct{}),
+	}
+	if err := s.removeTemps(); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := s.Load()
+	if err != nil && err != ErrNoSnapshot {
+		return nil, err
+	}
+	s.latest = snapshot
+	return s, nil
+}
+
+// Save write snapshot to a new file atomically, and release snapshots
+// beyond retention. Snapshot older than the latest one, or the same as
+// it, is ignored.
+func (s *Store) Save(snapshot *raftpd.Snapshot) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.latest != nil && snapshot.Metadata.Index < s.latest.Metadata.Index {
+		log.Debugf("snap %s ignore snapshot [index: %d] older than latest [index: %d]",
+			s.dir, snapshot.Metadata.Index, s.latest.Metadata.Index)
+		return nil
+	}
+	if s.latest != nil && snapshot.Metadata.Index == s.latest.Metadata.Index &&
+		snapshot.Metadata.Term == s.latest.Metadata.Term {
+		/* such as the latest applied again on restart */
+		return nil
+	}
+
+	data, err := encode(snapshot)
+	if err != nil {
+		return err
+	}
+	name := snapName(&snapshot.Metadata)
+	if err := writeFileAtomic(s.dir, name, data); err != nil {
+		return err
+	}
+	s.latest = snapshot
+
+	log.Debugf("snap %s save snapshot [index: %d, term: %d, size: %d]",
+		s.dir, snapshot.Metadata.Index, snapshot.Metadata.Term, len(data))
+
+	return s.release()
+}
+
+// Load return the newest valid snapshot in dir, corrupted snapshots
+// are skipped. It returns ErrNoSnapshot if there is none.
+func (s *Store) Load() (*raftpd.Snapshot, error) {
+	names, err := s.snapNames()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		snapshot, err := Read(filepath.Join(s.dir, names[i]))
+		if err == nil {
+			return snapshot, nil
+		}
+		log.Warnf("snap %s skip snapshot %s: %v", s.dir, names[i], err)
+	}
+	return nil, ErrNoSnapshot
+}
+
+// ReadSnapshot return the latest snapshot, or nil if there is
+// none. It could be used as Application.ReadSnapshot.
+func (s *Store) ReadSnapshot() *raftpd.Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.latest
+}
+
+// ApplySnapshot save snapshot received from leader, it could be
+// used by Application.ApplySnapshot. Raft has discarded entries
+// before snapshot, so if it could not be saved, store fails: Done
+// is closed and Err returns the failure, application should stop
+// raft then.
+func (s *Store) ApplySnapshot(snapshot *raftpd.Snapshot) {
+	err := s.Save(snapshot)
+	if err == nil {
+		return
+	}
+	log.Errorf("snap %s save snapshot [index: %d, term: %d]: %v",
+		s.dir, snapshot.Metadata.Index, snapshot.Metadata.Term, err)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failure == nil {
+		s.failure = err
+		close(s.donec)
+	}
+}
+
+// Done return a channel which is closed when store fails.
+func (s *Store) Done() <-chan struct{} {
+	return s.donec
+}
+
+// Err return the failure of ApplySnapshot, it returns
+// nil if store hasn't failed.
+func (s *Store) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failure
+}
+
+// Read read and verify snapshot file at path.
+func Read(path string) (*raftpd.Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// release remove snapshots beyond retention.
+func (s *Store) release() error {
+	names, err := s.snapNames()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+s.retain < len(names); i++ {
+		if err := os.Remove(filepath.Join(s.dir, names[i])); err != nil {
+			return err
+		}
+		log.Debugf("snap %s release snapshot %s", s.dir, names[i])
+	}
+	return nil
+}
+
+// removeTemps remove temporary files left by crash.
+func (s *Store) removeTemps() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), tmpSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapNames return names of snapshot files, in ascending order of index.
+func (s *Store) snapNames() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), snapSuffix) {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	/* index is the leading fixed width hex, so names sort by index */
+	sort.Strings(names)
+	return names, nil
+}
+
+func snapName(metadata *raftpd.SnapshotMetadata) string {
+	return fmt.Sprintf("%016x-%016x%s", metadata.Index, metadata.Term, snapSuffix)
+}
+
+// encode snapshot as: | magic | crc32 | metadata size | metadata | data |,
+// crc32 covers all bytes after it.
+func encode(snapshot *raftpd.Snapshot) ([]byte, error) {
+	metadata, err := pd.BinaryCodec.Marshal(&snapshot.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, headerSize, headerSize+binary.MaxVarintLen64+
+		len(metadata)+len(snapshot.Data))
+	copy(buf, snapMagic)
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(metadata)))
+	buf = append(buf, size[:n]...)
+	buf = append(buf, metadata...)
+	buf = append(buf, snapshot.Data...)
+	binary.BigEndian.PutUint32(buf[len(snapMagic):], crc32.Checksum(buf[headerSize:], crcTable))
+	return buf, nil
+}
+
+func decode(data []byte) (*raftpd.Snapshot, error) {
+	if len(data) < headerSize || string(data[:len(snapMagic)]) != string(snapMagic) {
+		return nil, ErrBadFormat
+	}
+	crc := binary.BigEndian.Uint32(data[len(snapMagic):])
+	body := data[headerSize:]
+	if crc32.Checksum(body, crcTable) != crc {
+		return nil, ErrCRCMismatch
+	}
+
+	size, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < size {
+		return nil, ErrBadFormat
+	}
+	snapshot := &raftpd.Snapshot{}
+	if err := pd.Unmarshal(&snapshot.Metadata, body[n:n+int(size)]); err != nil {
+		return nil, err
+	}
+	if rest := body[n+int(size):]; len(rest) > 0 {
+		snapshot.Data = rest
+	}
+	return snapshot, nil
+}
+
+// writeFileAtomic write data to a temporary file, sync and
+// rename it to name, then sync dir to persist the rename.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp := filepath.Join(dir, name+tmpSuffix)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,162 @@
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+func makeTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bior-snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func makeSnapshot(index uint64) *raftpd.Snapshot {
+	return &raftpd.Snapshot{
+		Metadata: raftpd.SnapshotMetadata{
+			Index:     index,
+			Term:      index / 2,
+			ConfState: raftpd.ConfState{Nodes: []uint64{1, 2, 3}},
+		},
+		Data: []byte{byte(index), 1, 2, 3},
+	}
+}
+
+func TestStore_SaveLoad(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := MakeStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.ReadSnapshot() != nil {
+		t.Fatalf("empty store should have no snapshot")
+	}
+	for _, index := range []uint64{3, 5, 7, 4} {
+		if err := store.Save(makeSnapshot(index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if get := store.ReadSnapshot(); !reflect.DeepEqual(get, makeSnapshot(7)) {
+		t.Fatalf("latest want: %v, get: %v", makeSnapshot(7), get)
+	}
+	names, _ := store.snapNames()
+	if len(names) != 2 {
+		t.Fatalf("retained snapshots want: 2, get: %v", names)
+	}
+
+	reopen, err := MakeStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get := reopen.ReadSnapshot(); !reflect.DeepEqual(get, makeSnapshot(7)) {
+		t.Fatalf("loaded want: %v, get: %v", makeSnapshot(7), get)
+	}
+}
+
+func TestStore_ApplySnapshot(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := MakeStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.ApplySnapshot(makeSnapshot(3))
+	names, _ := store.snapNames()
+	if len(names) != 1 {
+		t.Fatalf("snapshots want: 1, get: %v", names)
+	}
+
+	/* the latest snapshot isn't written again */
+	if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+		t.Fatal(err)
+	}
+	store.ApplySnapshot(makeSnapshot(3))
+	if names, _ := store.snapNames(); len(names) != 0 {
+		t.Fatalf("latest snapshot should not be written again, get: %v", names)
+	}
+	if store.Err() != nil {
+		t.Fatalf("store should not fail, get: %v", store.Err())
+	}
+
+	/* failure is reported by Done and Err */
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	store.ApplySnapshot(makeSnapshot(5))
+	select {
+	case <-store.Done():
+	default:
+		t.Fatalf("store should be done after failure")
+	}
+	if store.Err() == nil {
+		t.Fatalf("store should report failure")
+	}
+}
+
+func TestStore_LoadSkipCorrupted(t *testing.T) {
+	tests := []struct {
+		corrupt func(data []byte) []byte
+		err     error
+	}{
+		{func(data []byte) []byte { data[len(data)-1]++; return data }, ErrCRCMismatch},
+		{func(data []byte) []byte { return data[:len(data)-1] }, ErrCRCMismatch},
+		{func(data []byte) []byte { return data[:4] }, ErrBadFormat},
+		{func(data []byte) []byte { data[0]++; return data }, ErrBadFormat},
+	}
+
+	for i, test := range tests {
+		dir := makeTestDir(t)
+		store, err := MakeStore(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Save(makeSnapshot(3))
+		store.Save(makeSnapshot(5))
+
+		path := filepath.Join(dir, snapName(&makeSnapshot(5).Metadata))
+		data, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(path, test.corrupt(data), 0666)
+		if _, err := Read(path); err != test.err {
+			t.Fatalf("#%d: read err want: %v, get: %v", i, test.err, err)
+		}
+
+		reopen, err := MakeStore(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if get := reopen.ReadSnapshot(); !reflect.DeepEqual(get, makeSnapshot(3)) {
+			t.Fatalf("#%d: loaded want: %v, get: %v", i, makeSnapshot(3), get)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore_RemoveTemps(t *testing.T) {
+	dir := makeTestDir(t)
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, snapName(&makeSnapshot(3).Metadata)+tmpSuffix)
+	ioutil.WriteFile(tmp, []byte("partial"), 0666)
+
+	store, err := MakeStore(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.ReadSnapshot() != nil {
+		t.Fatalf("partial snapshot should not be loaded")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("temporary file should be removed: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/thinkermao/bior/raft/core"
+	"github.com/thinkermao/bior/raft/core/conf"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// SnapshotApplication could be implemented by Application to take
+// snapshot automatically by SnapshotPolicy, or on demand when a
+// follower needs snapshot but ReadSnapshot returns nil.
+type SnapshotApplication interface {
+	// SaveSnapshot persist snapshot of state machine with metadata,
+	// state machine has applied all entries up to metadata.Index,
+	// and ReadSnapshot should return it after that. It is called
+	// by the goroutine applies entries, between entries applied.
+	SaveSnapshot(metadata *raftpd.SnapshotMetadata) error
+}
+
+// SnapshotPolicy decides when to take snapshot and compact log, it is
+// disabled if both Entries and Bytes are zero. Snapshot is taken after
+// Entries entries, or Bytes bytes of entries applied since last one,
+// but not within Interval after last one.
+type SnapshotPolicy struct {
+	Entries  uint64
+	Bytes    uint64
+	Interval time.Duration
+
+	// CatchUpEntries is the number of entries kept before snapshot
+	// when compact log, so that slow followers could catch up from
+	// log instead of snapshot.
+	CatchUpEntries uint64
+}
+
+func (p *SnapshotPolicy) enabled() bool {
+	return p.Entries != 0 || p.Bytes != 0
+}
+
+// due test whether snapshot should be taken, after entries and
+// bytes applied since last snapshot taken at last.
+func (p *SnapshotPolicy) due(entries, bytes uint64, last time.Time) bool {
+	if !p.enabled() {
+		return false
+	}
+	if p.Interval != 0 && time.Since(last) < p.Interval {
+		return false
+	}
+	return (p.Entries != 0 && entries >= p.Entries) ||
+		(p.Bytes != 0 && bytes >= p.Bytes)
+}
+
+// compactIndex return index log is compacted to, after
+// snapshot taken at index.
+func (p *SnapshotPolicy) compactIndex(index uint64) uint64 {
+	if index <= p.CatchUpEntries {
+		return conf.InvalidIndex
+	}
+	return index - p.CatchUpEntries
+}
+
+// RequestSnapshot implements core.SnapshotRequester, it forwards
+// request to Application if it implements core.SnapshotRequester,
+// otherwise takes snapshot by SnapshotApplication. Snapshot taken
+// on request compacts log only if SnapshotPolicy is enabled, and
+// CatchUpEntries entries are kept as well.
+func (raft *Raft) RequestSnapshot(nodeID uint64) {
+	if requester, ok := raft.callback.(core.SnapshotRequester); ok {
+		requester.RequestSnapshot(nodeID)
+	} else if _, ok := raft.callback.(SnapshotApplication); ok {
+		raft.applier.requestSnapshot()
+	}
+}
+
+// compact discard entries before snapshot taken at index,
+// except the window kept for slow followers.
+func (raft *Raft) compact(index uint64) {
+	raft.membership.compact(index)
+	metadata, ok := raft.raft.Compact(raft.applier.policy.compactIndex(index))
+	if !ok {
+		return
+	}
+
+	if err := raft.storage.Compact(Metadata{
+		Index: metadata.Index,
+		Term:  metadata.Term,
+	}); err != nil {
+		raft.fail(err)
+	}
+}
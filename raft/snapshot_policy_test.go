@@ -0,0 +1,220 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/core/conf"
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+type snapshotApplication struct {
+	nopApplication
+	mutex     sync.Mutex
+	snapshots []raftpd.SnapshotMetadata
+}
+
+func (app *snapshotApplication) SaveSnapshot(metadata *raftpd.SnapshotMetadata) error {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.snapshots = append(app.snapshots, *metadata)
+	return nil
+}
+
+func (app *snapshotApplication) lastSnapshot() (raftpd.SnapshotMetadata, bool) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if len(app.snapshots) == 0 {
+		return raftpd.SnapshotMetadata{}, false
+	}
+	return app.snapshots[len(app.snapshots)-1], true
+}
+
+func TestSnapshotPolicy_Due(t *testing.T) {
+	recent := time.Now()
+	tests := []struct {
+		policy  SnapshotPolicy
+		entries uint64
+		bytes   uint64
+		last    time.Time
+		due     bool
+	}{
+		{SnapshotPolicy{}, 100, 100, time.Time{}, false},
+		{SnapshotPolicy{Entries: 10}, 9, 100, time.Time{}, false},
+		{SnapshotPolicy{Entries: 10}, 10, 0, time.Time{}, true},
+		{SnapshotPolicy{Bytes: 10}, 100, 9, time.Time{}, false},
+		{SnapshotPolicy{Bytes: 10}, 1, 10, time.Time{}, true},
+		{SnapshotPolicy{Entries: 10, Interval: time.Hour}, 10, 0, recent, false},
+		{SnapshotPolicy{Entries: 10, Interval: time.Hour}, 10, 0, time.Time{}, true},
+	}
+
+	for i, test := range tests {
+		if due := test.policy.due(test.entries, test.bytes, test.last); due != test.due {
+			t.Fatalf("#%d: due want: %v, get: %v", i, test.due, due)
+		}
+	}
+}
+
+func TestSnapshotPolicy_CompactIndex(t *testing.T) {
+	tests := []struct {
+		catchUp uint64
+		index   uint64
+		want    uint64
+	}{
+		{0, 10, 10},
+		{3, 10, 7},
+		{10, 10, 0},
+		{20, 10, 0},
+	}
+
+	for i, test := range tests {
+		policy := SnapshotPolicy{CatchUpEntries: test.catchUp}
+		if index := policy.compactIndex(test.index); index != test.want {
+			t.Fatalf("#%d: compact index want: %d, get: %d", i, test.want, index)
+		}
+	}
+}
+
+func TestRaft_SnapshotPolicy(t *testing.T) {
+	app := &snapshotApplication{}
+	storage := MakeMemoryStorage(Metadata{})
+	config := &Config{
+		ID:               1,
+		Nodes:            []uint64{1},
+		ElectionTimeout:  50,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		Snapshot:         SnapshotPolicy{Entries: 4, CatchUpEntries: 2},
+		Application:      app,
+		Transport:        nopTransport{},
+	}
+	state := raftpd.HardState{Vote: conf.InvalidID}
+	raft := buildRaft(config, storage, nil, state, conf.InvalidIndex, raftpd.ConfState{Nodes: []uint64{1}})
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; {
+		_, err := raft.ProposeWait(ctx, []byte("data"))
+		if err == ErrNotLeader {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		} else if err != nil {
+			t.Fatalf("#%d: propose wait: %v", i, err)
+		}
+		i++
+	}
+
+	for {
+		snapshot, ok := app.lastSnapshot()
+		entries, _, _ := storage.Load()
+		if ok && entries[0].Index == snapshot.Index-2 {
+			if len(snapshot.ConfState.Nodes) != 1 {
+				t.Fatalf("snapshot should be stamped by configuration: %v", snapshot)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("log should be compacted to 2 entries before snapshot %v, first: %d",
+				snapshot, entries[0].Index)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestApplier_RequestSnapshot(t *testing.T) {
+	app := &snapshotApplication{}
+	raft := makeRaft(1)
+	raft.callback = app
+	a := raft.applier
+
+	tests := []struct {
+		policy   SnapshotPolicy
+		applied  []raftpd.Entry
+		snapshot uint64 /* index of snapshot taken, zero if none */
+		compact  uint64 /* index of snapshot to compact log */
+	}{
+		/* nothing applied */
+		{SnapshotPolicy{}, nil, 0, 0},
+		/* log isn't compacted if policy is disabled */
+		{SnapshotPolicy{}, makeApplyEntries(1, 3), 3, 0},
+		/* nothing applied since last snapshot */
+		{SnapshotPolicy{}, nil, 0, 0},
+		{SnapshotPolicy{Entries: 100, CatchUpEntries: 2}, makeApplyEntries(4, 5), 5, 5},
+	}
+	for i, test := range tests {
+		count := len(app.snapshots)
+		a.policy = test.policy
+		a.advance(test.applied)
+		raft.RequestSnapshot(2)
+		a.maybeSnapshot()
+
+		snapshot, _ := app.lastSnapshot()
+		if test.snapshot == 0 && len(app.snapshots) != count {
+			t.Fatalf("#%d: snapshot should not be taken, get: %v", i, snapshot)
+		}
+		if test.snapshot != 0 && (len(app.snapshots) != count+1 || snapshot.Index != test.snapshot) {
+			t.Fatalf("#%d: snapshot want: %d, get: %v", i, test.snapshot, snapshot)
+		}
+		if index := a.takeSnapshotIndex(); index != test.compact {
+			t.Fatalf("#%d: compact index want: %d, get: %d", i, test.compact, index)
+		}
+	}
+}
+
+func TestRaft_SnapshotAtConfChange(t *testing.T) {
+	app := &snapshotApplication{}
+	config := &Config{
+		ID:               1,
+		Nodes:            []uint64{1},
+		ElectionTimeout:  50,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		Snapshot:         SnapshotPolicy{Entries: 1},
+		Application:      app,
+		Transport:        nopTransport{},
+	}
+	state := raftpd.HardState{Vote: conf.InvalidID}
+	raft := buildRaft(config, MakeMemoryStorage(Metadata{}), nil,
+		state, conf.InvalidIndex, raftpd.ConfState{Nodes: []uint64{1}})
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, err := raft.ProposeWait(ctx, nil)
+		if err == nil {
+			break
+		} else if err != ErrNotLeader {
+			t.Fatalf("propose wait: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cc := raftpd.ConfChange{ChangeType: raftpd.ConfChangeLearnerNode, NodeID: 2}
+	index, _, isLeader := raft.ProposeConfChange(&cc)
+	if !isLeader {
+		t.Fatalf("propose conf change should be accepted")
+	}
+
+	for {
+		snapshot, _ := app.lastSnapshot()
+		if snapshot.Index >= index {
+			/* snapshot covers conf change is stamped by it */
+			if len(snapshot.ConfState.Learners) != 1 || snapshot.ConfState.Learners[0] != 2 {
+				t.Fatalf("snapshot at %d should contain learner 2, get: %v", snapshot.Index, snapshot)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("snapshot should be taken at conf change %d", index)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
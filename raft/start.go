@@ -0,0 +1,241 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/core/conf"
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+	"github.com/thinkermao/wal-go"
+)
+
+// Config is the configuration to start raft.
+type Config struct {
+	ID uint64
+	// Nodes is the members of cluster at bootstrap, configuration
+	// persisted in snapshot and wal is used on restart.
+	Nodes []uint64
+
+	// ElectionTimeout, HeartbeatTimeout and TickSize are in milliseconds.
+	ElectionTimeout  int
+	HeartbeatTimeout int
+	TickSize         int
+	MaxSizePerMsg    uint
+	// ReadOnlyOption specifies how ReadIndex is processed, it is
+	// conf.ReadOnlySafe by default. conf.ReadOnlyLeaseBased saves
+	// heartbeats of most reads, but relies on bounded clock drift.
+	ReadOnlyOption conf.ReadOnlyOption
+
+	// WalDir is the directory of wal, raft bootstraps on it if no
+	// wal exists, otherwise restarts from state of it.
+	WalDir string
+	// Codec encodes records of wal, pd.GobCodec is used if nil. Wal
+	// of any codec could be read, but use pd.BinaryCodec only if the
+	// node would never be rolled back to version without it.
+	Codec pd.Codec
+
+	// Snapshot is the policy to take snapshot automatically, it takes
+	// effect if Application implements SnapshotApplication.
+	Snapshot SnapshotPolicy
+	// Metrics observes raft if not nil.
+	Metrics Metrics
+
+	Application Application
+	Transport   Transporter
+}
+
+// StartRaft start raft on config.WalDir. If wal exists, the latest
+// snapshot is read by Application.ReadSnapshot, and wal is restored
+// after it. Application.ApplySnapshot is called once before raft
+// starts, with the latest snapshot or an empty one at bootstrap, so
+// that application could reset its state. It refuses to start if
+// wal is inconsistent with snapshot.
+func StartRaft(config *Config) (*Raft, error) {
+	codec := config.Codec
+	if codec == nil {
+		codec = pd.GobCodec
+	}
+
+	exists, err := walExists(config.WalDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &raftpd.Snapshot{
+		Metadata: raftpd.SnapshotMetadata{
+			Index: conf.InvalidIndex,
+			Term:  conf.InvalidTerm,
+		},
+	}
+	if !exists {
+		if err := removeLeftovers(config.WalDir); err != nil {
+			return nil, err
+		}
+		storage, err := CreateLogStorage(config.WalDir, Metadata{}, codec)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Application.ApplySnapshot(snapshot)
+		state := raftpd.HardState{
+			Vote: conf.InvalidID,
+			Term: conf.InvalidTerm,
+		}
+		confState := raftpd.ConfState{Nodes: config.Nodes}
+		return buildRaft(config, storage, nil, state, conf.InvalidIndex, confState), nil
+	}
+
+	if latest := config.Application.ReadSnapshot(); latest != nil {
+		snapshot = latest
+	}
+	meta := Metadata{
+		Index: snapshot.Metadata.Index,
+		Term:  snapshot.Metadata.Term,
+	}
+	storage, err := RestoreLogStorage(config.WalDir, meta, codec)
+	if err != nil {
+		return nil, err
+	}
+	entries, state, err := storage.Load()
+	if err == nil {
+		err = checkConsistency(meta, entries, &state)
+	}
+	var confIndex uint64
+	var confState raftpd.ConfState
+	if err == nil {
+		confIndex, confState, err = latestConfState(config, &snapshot.Metadata, storage)
+	}
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	config.Application.ApplySnapshot(snapshot)
+	raft := buildRaft(config, storage, entries, state, confIndex, confState)
+	// state machine has been restored to snapshot.
+	raft.do(func() {
+		raft.applier.appliedTo(&snapshot.Metadata)
+		raft.raft.AppliedTo(snapshot.Metadata.Index)
+		raft.metrics.SetAppliedIndex(snapshot.Metadata.Index)
+	})
+	return raft, nil
+}
+
+// latestConfState return the latest configuration of snapshot and
+// wal, and the index it applied at. Nodes of config is used if
+// neither of them has configuration.
+func latestConfState(config *Config, metadata *raftpd.SnapshotMetadata,
+	storage Storage) (uint64, raftpd.ConfState, error) {
+	index, state, err := storage.LoadConfState()
+	if err != nil {
+		return conf.InvalidIndex, state, err
+	}
+	if len(metadata.ConfState.Nodes) != 0 && metadata.Index >= index {
+		return metadata.Index, metadata.ConfState, nil
+	}
+	if index == conf.InvalidIndex {
+		return index, raftpd.ConfState{Nodes: config.Nodes}, nil
+	}
+	return index, state, nil
+}
+
+// walExists test whether walDir has any state, that is a segment with
+// at least one record, or such wal written directly into walDir by
+// versions before segments. Bootstrap interrupted before any record
+// written leaves an empty segment or stray files, they aren't state.
+func walExists(walDir string) (bool, error) {
+	infos, err := ioutil.ReadDir(walDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	segments, err := readSegments(walDir)
+	if err != nil {
+		return false, err
+	}
+	if len(segments) == 0 {
+		for _, info := range infos {
+			if info.Name() == legacyMigrating {
+				/* legacy wal is being migrated */
+				return true, nil
+			}
+		}
+		return len(infos) > 0 && hasRecord(walDir), nil
+	}
+	for _, index := range segments {
+		if hasRecord(filepath.Join(walDir, fmt.Sprintf("%016x", index))) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasRecord test whether wal at dir could be read and has any record.
+func hasRecord(dir string) bool {
+	var found bool
+	w, err := wal.Open(dir, conf.InvalidIndex, func(index uint64, data []byte) error {
+		found = true
+		return nil
+	})
+	if err != nil {
+		log.Warnf("wal %s could not be read: %v", dir, err)
+		return false
+	}
+	if err := w.Close(); err != nil {
+		log.Warnf("wal %s close: %v", dir, err)
+	}
+	return found
+}
+
+// removeLeftovers remove everything in walDir before bootstrap, they
+// are left by bootstrap interrupted before any record written.
+func removeLeftovers(walDir string) error {
+	infos, err := ioutil.ReadDir(walDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		log.Warnf("wal %s remove %s left by interrupted bootstrap", walDir, info.Name())
+		if err := os.RemoveAll(filepath.Join(walDir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConsistency test whether entries and hard state
+// loaded from wal could be continued after snapshot.
+func checkConsistency(meta Metadata, entries []raftpd.Entry, state *raftpd.HardState) error {
+	if len(entries) == 0 || entries[0].Index != meta.Index || entries[0].Term != meta.Term {
+		return fmt.Errorf("wal doesn't start at snapshot [index: %d, term: %d]",
+			meta.Index, meta.Term)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Index != entries[i-1].Index+1 {
+			return fmt.Errorf("wal has a gap between entry %d and %d",
+				entries[i-1].Index, entries[i].Index)
+		}
+		if entries[i].Term < entries[i-1].Term {
+			return fmt.Errorf("term of entry %d decreases", entries[i].Index)
+		}
+	}
+
+	last := entries[len(entries)-1]
+	if len(entries) > 1 && last.Term > state.Term {
+		return fmt.Errorf("term of entry %d is larger than hard state [term: %d]",
+			last.Index, state.Term)
+	}
+	if state.Commit > last.Index {
+		return fmt.Errorf("commit index %d is out of wal [last index: %d]",
+			state.Commit, last.Index)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+	"github.com/thinkermao/wal-go"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	tests := []struct {
+		meta    Metadata
+		entries []raftpd.Entry
+		state   raftpd.HardState
+		ok      bool
+	}{
+		{Metadata{1, 1}, makeEntries(1, 2, 3), raftpd.HardState{Term: 3, Commit: 3}, true},
+		{Metadata{3, 3}, makeEntries(3), raftpd.HardState{Term: 3, Commit: 3}, true},
+		/* snapshot is newer than wal */
+		{Metadata{3, 3}, makeEntries(3), raftpd.HardState{Term: 2, Commit: 2}, true},
+		/* wal doesn't start at snapshot */
+		{Metadata{2, 2}, makeEntries(1, 2), raftpd.HardState{Term: 2}, false},
+		/* gap */
+		{Metadata{1, 1}, makeEntries(1, 3), raftpd.HardState{Term: 3}, false},
+		/* hard state is older than entries */
+		{Metadata{1, 1}, makeEntries(1, 2, 3), raftpd.HardState{Term: 2}, false},
+		/* commit out of wal */
+		{Metadata{1, 1}, makeEntries(1, 2), raftpd.HardState{Term: 2, Commit: 3}, false},
+	}
+
+	for i, test := range tests {
+		err := checkConsistency(test.meta, test.entries, &test.state)
+		if (err == nil) != test.ok {
+			t.Fatalf("#%d: consistent want: %v, get: %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestWalExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bior-start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walDir := filepath.Join(dir, "wal")
+	segment := filepath.Join(walDir, "0000000000000000")
+	tests := []struct {
+		prepare func() error
+		exists  bool
+	}{
+		{func() error { return nil }, false},
+		{func() error { return os.Mkdir(walDir, 0777) }, false},
+		/* stray file left by interrupted bootstrap */
+		{func() error { return ioutil.WriteFile(filepath.Join(walDir, "stray"), nil, 0666) }, false},
+		/* empty segment left by interrupted bootstrap */
+		{func() error {
+			w, err := wal.Create(segment, 0)
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		}, false},
+		{func() error {
+			os.RemoveAll(walDir)
+			writeSegments(t, walDir)
+			return nil
+		}, true},
+		/* legacy wal written into walDir directly */
+		{func() error {
+			os.RemoveAll(walDir)
+			os.Mkdir(walDir, 0777)
+			writeLegacyWal(t, walDir, makeRangeEntries(1, 3), &raftpd.HardState{Term: 3})
+			return nil
+		}, true},
+		/* legacy wal is being migrated */
+		{func() error { return os.Mkdir(filepath.Join(walDir, legacyMigrating), 0777) }, true},
+	}
+
+	for i, test := range tests {
+		if err := test.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		exists, err := walExists(walDir)
+		if err != nil || exists != test.exists {
+			t.Fatalf("#%d: exists want: %v, get: %v, %v", i, test.exists, exists, err)
+		}
+	}
+}
+
+func TestStartRaft_Legacy(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	state := raftpd.HardState{Term: 3, Vote: 1, Commit: 3}
+	writeLegacyWal(t, walDir, makeRangeEntries(1, 3), &state)
+
+	raft, err := StartRaft(&Config{
+		ID:               1,
+		Nodes:            []uint64{1},
+		ElectionTimeout:  50,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		WalDir:           walDir,
+		Application:      &nopApplication{},
+		Transport:        nopTransport{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		index, err := raft.ProposeWait(ctx, nil)
+		if err == ErrNotLeader {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		} else if err != nil {
+			t.Fatalf("propose wait: %v", err)
+		}
+		/* entries of legacy wal are kept, and term continues */
+		if term, _ := raft.GetState(); index <= 3 || term <= state.Term {
+			t.Fatalf("raft should restart from legacy wal, get index: %d, term: %d", index, term)
+		}
+		break
+	}
+}
+
+// TestStartRaft_InterruptedBootstrap ensures that raft bootstraps again
+// over an empty segment and stray files left by interrupted bootstrap.
+func TestStartRaft_InterruptedBootstrap(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	w, err := wal.Create(filepath.Join(walDir, "0000000000000000"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(walDir, "stray"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	raft, err := StartRaft(&Config{
+		ID:               1,
+		Nodes:            []uint64{1},
+		ElectionTimeout:  50,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		WalDir:           walDir,
+		Application:      &nopApplication{},
+		Transport:        nopTransport{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	if _, err := os.Stat(filepath.Join(walDir, "stray")); !os.IsNotExist(err) {
+		t.Fatalf("stray file should be removed, get: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		index, err := raft.ProposeWait(ctx, nil)
+		if err == ErrNotLeader {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		} else if err != nil {
+			t.Fatalf("propose wait: %v", err)
+		}
+		/* log starts from empty, noop entry might precede */
+		if index > 2 {
+			t.Fatalf("raft should bootstrap, get index: %d", index)
+		}
+		break
+	}
+}
+
+type restartApplication struct {
+	nopApplication
+	snapshot *raftpd.Snapshot
+}
+
+func (app *restartApplication) ReadSnapshot() *raftpd.Snapshot {
+	return app.snapshot
+}
+
+func TestStartRaft_Snapshot(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	meta := Metadata{Index: 5, Term: 2}
+	storage, err := CreateLogStorage(walDir, meta, pd.BinaryCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveHardState(&raftpd.HardState{Term: 2, Commit: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &restartApplication{snapshot: &raftpd.Snapshot{
+		Metadata: raftpd.SnapshotMetadata{
+			Index:     meta.Index,
+			Term:      meta.Term,
+			ConfState: raftpd.ConfState{Nodes: []uint64{1}},
+		},
+	}}
+	raft, err := StartRaft(&Config{
+		ID: 1,
+		/* never campaign, so nothing is applied after snapshot */
+		ElectionTimeout:  100000,
+		HeartbeatTimeout: 10,
+		TickSize:         5,
+		MaxSizePerMsg:    1024 * 1024,
+		WalDir:           walDir,
+		Application:      app,
+		Transport:        nopTransport{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raft.Kill()
+
+	if status := raft.Status(); status.Applied != meta.Index {
+		t.Fatalf("applied want: %d, get: %d", meta.Index, status.Applied)
+	}
+	raft.applier.mutex.Lock()
+	defer raft.applier.mutex.Unlock()
+	if raft.applier.applied != meta.Index || raft.applier.appliedTerm != meta.Term {
+		t.Fatalf("applier want applied (%d, %d), get: (%d, %d)", meta.Index, meta.Term,
+			raft.applier.applied, raft.applier.appliedTerm)
+	}
+}
@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"github.com/thinkermao/bior/raft/proto"
+)
+
+// Metadata describes the first entry of log storage,
+// usually it is the index and term of last snapshot.
+type Metadata struct {
+	Index uint64
+	Term  uint64
+}
+
+// Storage is interface used by raft to persist log entries,
+// hard state and configuration. Entries and hard state saved are not required
+// to be durable until Sync returns.
+type Storage interface {
+	// SaveEntries save entries to storage, entries which index
+	// is not less than entries[0].Index will be overwritten.
+	SaveEntries(entries []raftpd.Entry) error
+	// SaveHardState save hard state to storage.
+	SaveHardState(state *raftpd.HardState) error
+	// SaveConfState save configuration of raft group, which
+	// is the result of conf changes applied up to index.
+	SaveConfState(index uint64, state *raftpd.ConfState) error
+	// Sync flush all saved records to stable storage.
+	Sync() error
+
+	// Load return all entries and latest hard state in storage,
+	// entries has a dummy entry from metadata.
+	Load() ([]raftpd.Entry, raftpd.HardState, error)
+	// LoadConfState return latest configuration in storage and
+	// the index it applied at, index is zero if nothing saved.
+	LoadConfState() (uint64, raftpd.ConfState, error)
+	// Compact discard all entries before meta.Index, meta will
+	// become the new dummy entry.
+	Compact(meta Metadata) error
+
+	Close() error
+}
+
+func dummyEntry(meta Metadata) raftpd.Entry {
+	return raftpd.Entry{
+		Type:  raftpd.EntryNormal,
+		Index: meta.Index,
+		Term:  meta.Term,
+	}
+}
+
+// compactEntries discard entries before meta.Index, and
+// replace dummy entry by meta. Older meta is ignored.
+func compactEntries(entries []raftpd.Entry, meta Metadata) []raftpd.Entry {
+	if meta.Index <= entries[0].Index {
+		/* compact by older snapshot */
+		return entries
+	}
+
+	compacted := []raftpd.Entry{dummyEntry(meta)}
+	for i := 0; i < len(entries); i++ {
+		if entries[i].Index > meta.Index {
+			compacted = append(compacted, entries[i])
+		}
+	}
+	return compacted
+}
+
+// appendEntry truncate entries whose index not less than entry,
+// and append entry to the end.
+func appendEntry(entries []raftpd.Entry, entry *raftpd.Entry) []raftpd.Entry {
+	idx := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entry.Index > entries[i].Index {
+			idx = i + 1
+			break
+		}
+	}
+	return append(entries[:idx], *entry)
+}
@@ -5,10 +5,11 @@ import (
 )
 
 // Transporter is interface used by raft to send
-// Message to others.
+// Message to others. Message could be encoded by any
+// pd.Codec, and decoded by pd.Unmarshal on remote.
 type Transporter interface {
-	// Send send message to remote `to`,
-	// return after all message have been received
-	// by remote.
+	// Send send message to remote `to`. Transporter could
+	// send message asynchronously, and report failures by
+	// Raft.Unreachable or Raft.ReportSnapshot later.
 	Send(to uint64, msg pd.Messager) error
 }
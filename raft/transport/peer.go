@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/core"
+)
+
+const (
+	pipelineQueueSize = 4096
+	snapshotQueueSize = 16
+
+	dialTimeout  = 1 * time.Second
+	writeTimeout = 5 * time.Second
+
+	minBackoff = 50 * time.Millisecond
+	maxBackoff = 2 * time.Second
+)
+
+// peer holds the streams to remote node.
+type peer struct {
+	id       uint64
+	addr     string
+	pipeline *stream
+	snapshot *stream
+}
+
+func makePeer(t *Transport, id uint64, addr string) *peer {
+	p := &peer{id: id, addr: addr}
+	p.pipeline = makeStream(t, p, streamPipeline, pipelineQueueSize)
+	p.snapshot = makeStream(t, p, streamSnapshot, snapshotQueueSize)
+	return p
+}
+
+func (p *peer) stop() {
+	p.pipeline.stop()
+	p.snapshot.stop()
+}
+
+// stream is a persistent connection to peer, messages queued are
+// written in order, and connection is re-dialed with backoff after
+// it broken.
+type stream struct {
+	transport *Transport
+	peer      *peer
+	kind      streamKind
+
+	queue chan []byte
+	stopc chan struct{}
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	stopped bool
+}
+
+func makeStream(t *Transport, p *peer, kind streamKind, size int) *stream {
+	s := &stream{
+		transport: t,
+		peer:      p,
+		kind:      kind,
+		queue:     make(chan []byte, size),
+		stopc:     make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go s.run()
+
+	return s
+}
+
+// send queue data without blocking.
+func (s *stream) send(data []byte) error {
+	select {
+	case <-s.stopc:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case s.queue <- data:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (s *stream) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stopc)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *stream) run() {
+	defer s.transport.wg.Done()
+
+	backoff := minBackoff
+	for {
+		conn, err := s.dial()
+		if err != nil {
+			log.Debugf("%d transport dial %v stream to %d failed: %v",
+				s.transport.id, s.kind, s.peer.id, err)
+
+			// messages can't wait unknown time, drop them and tell raft.
+			s.drop()
+
+			select {
+			case <-s.stopc:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		backoff = minBackoff
+		if !s.serve(conn) {
+			return
+		}
+	}
+}
+
+// dial connect to peer and send hello.
+func (s *stream) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", s.peer.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := writeHello(bufio.NewWriter(conn), s.transport.id, s.kind); err != nil {
+		s.closeConn()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serve write messages to conn until it broken, return false if
+// stream is stopped.
+func (s *stream) serve(conn net.Conn) bool {
+	defer s.closeConn()
+
+	writer := bufio.NewWriter(conn)
+	for {
+		var data []byte
+		select {
+		case <-s.stopc:
+			return false
+		case data = <-s.queue:
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := writeFrame(writer, data)
+		// pipeline messages until queue is empty.
+		for err == nil && len(s.queue) > 0 {
+			err = writeFrame(writer, <-s.queue)
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			log.Debugf("%d transport write %v stream to %d failed: %v",
+				s.transport.id, s.kind, s.peer.id, err)
+			s.report()
+			return true
+		}
+	}
+}
+
+func (s *stream) closeConn() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// drop discard messages queued, and report failure if any.
+func (s *stream) drop() {
+	dropped := false
+	for len(s.queue) > 0 {
+		<-s.queue
+		dropped = true
+	}
+	if dropped {
+		s.report()
+	}
+}
+
+func (s *stream) report() {
+	if s.kind == streamSnapshot {
+		s.transport.reportSnapshot(s.peer.id, core.SnapshotFailure)
+	} else {
+		s.transport.unreachable(s.peer.id)
+	}
+}
@@ -0,0 +1,343 @@
+// Package transport provides a TCP implementation of raft.Transporter.
+//
+// Each peer has two persistent connections, one pipelines ordinary
+// messages, and the other streams snapshot chunks, so that large snapshot
+// would not block heartbeats. Messages are encoded by pd.Codec and framed
+// by length. Broken connection is re-dialed with exponential backoff, and
+// messages failed to send are reported by `Raft.Unreachable` or
+// `Raft.ReportSnapshot`. Messages received are fed to `Raft.Step`.
+//
+// Usage:
+//
+//	t, err := transport.MakeTransport(id, addr, peers, pd.GobCodec)
+//	rf, err := raft.MakeRaft(..., t)
+//	t.Bind(rf)
+//	...
+//	t.Close()
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thinkermao/bior/raft/core"
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+)
+
+// maxFrameSize limits size of frame received.
+const maxFrameSize = 512 * 1024 * 1024 // 512MB
+
+var (
+	// ErrUnknownPeer means message is sent to peer not configured.
+	ErrUnknownPeer = errors.New("unknown peer")
+	// ErrQueueFull means too many messages are waiting to send.
+	ErrQueueFull = errors.New("send queue is full")
+	// ErrClosed means transport has been closed.
+	ErrClosed = errors.New("transport is closed")
+)
+
+// Raft is the interface of raft used by transport, it
+// is implemented by raft.Raft.
+type Raft interface {
+	Step(msg *raftpd.Message)
+	Unreachable(peer uint64)
+	ReportSnapshot(peer uint64, status core.SnapshotStatus)
+}
+
+// Transport implements raft.Transporter by TCP.
+type Transport struct {
+	id       uint64
+	codec    pd.Codec
+	listener net.Listener
+
+	mutex  sync.Mutex
+	peers  map[uint64]*peer
+	raft   Raft
+	conns  map[net.Conn]struct{} // accepted connections.
+	closed bool
+
+	wg sync.WaitGroup
+}
+
+// MakeTransport listen on addr, and return a instance of Transport. Peers
+// is the address of other nodes, messages sent are encoded by codec, or
+// pd.GobCodec if nil. Switch to pd.BinaryCodec only after every node of
+// cluster could decode it, otherwise older nodes fail to read messages.
+func MakeTransport(id uint64, addr string,
+	peers map[uint64]string, codec pd.Codec) (*Transport, error) {
+	if codec == nil {
+		codec = pd.GobCodec
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transport{
+		id:       id,
+		codec:    codec,
+		listener: listener,
+		peers:    make(map[uint64]*peer),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	for peerID, peerAddr := range peers {
+		t.AddPeer(peerID, peerAddr)
+	}
+
+	t.wg.Add(1)
+	go t.accept()
+
+	return t, nil
+}
+
+// Addr return the address transport listens on.
+func (t *Transport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Bind set raft which messages received are fed to, and failures
+// are reported to. Messages received before bind are dropped.
+func (t *Transport) Bind(raft Raft) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.raft = raft
+}
+
+// AddPeer add remote node, it does nothing if peer exists
+// or it is local node.
+func (t *Transport) AddPeer(id uint64, addr string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.peers[id]; ok || id == t.id || t.closed {
+		return
+	}
+	t.peers[id] = makePeer(t, id, addr)
+}
+
+// RemovePeer remove remote node, and stop streams to it.
+func (t *Transport) RemovePeer(id uint64) {
+	t.mutex.Lock()
+	p, ok := t.peers[id]
+	delete(t.peers, id)
+	t.mutex.Unlock()
+
+	if ok {
+		p.stop()
+	}
+}
+
+// Send implements raft.Transporter. Message is queued and sent in
+// background, failures are reported to raft asynchronously.
+func (t *Transport) Send(to uint64, msg pd.Messager) error {
+	raftMsg, ok := msg.(*raftpd.Message)
+	if !ok {
+		return fmt.Errorf("unsupported message type: %T", msg)
+	}
+
+	t.mutex.Lock()
+	p, ok := t.peers[to]
+	t.mutex.Unlock()
+	if !ok {
+		return ErrUnknownPeer
+	}
+
+	data, err := t.codec.Marshal(raftMsg)
+	if err != nil {
+		return err
+	}
+	if raftMsg.MsgType == raftpd.MsgSnapshotRequest {
+		return p.snapshot.send(data)
+	}
+	return p.pipeline.send(data)
+}
+
+// Close stop all connections, and wait background goroutines exit.
+func (t *Transport) Close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	peers := t.peers
+	t.peers = make(map[uint64]*peer)
+	t.mutex.Unlock()
+
+	err := t.listener.Close()
+	for _, p := range peers {
+		p.stop()
+	}
+	t.wg.Wait()
+	return err
+}
+
+func (t *Transport) getRaft() Raft {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.raft
+}
+
+func (t *Transport) unreachable(to uint64) {
+	if raft := t.getRaft(); raft != nil {
+		raft.Unreachable(to)
+	}
+}
+
+func (t *Transport) reportSnapshot(to uint64, status core.SnapshotStatus) {
+	if raft := t.getRaft(); raft != nil {
+		raft.ReportSnapshot(to, status)
+	}
+}
+
+func (t *Transport) accept() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			log.Debugf("%d transport stop accepting: %v", t.id, err)
+			return
+		}
+
+		t.mutex.Lock()
+		if t.closed {
+			t.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.mutex.Unlock()
+
+		t.wg.Add(1)
+		go t.serve(conn)
+	}
+}
+
+// serve read messages from conn, and feed them to raft.
+func (t *Transport) serve(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.conns, conn)
+		t.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	from, kind, err := readHello(reader)
+	if err != nil {
+		log.Debugf("%d transport read hello from %v failed: %v", t.id, conn.RemoteAddr(), err)
+		return
+	}
+	log.Debugf("%d transport accept %v stream from %d", t.id, kind, from)
+
+	for {
+		data, err := readFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("%d transport read from %d failed: %v", t.id, from, err)
+			}
+			return
+		}
+
+		var msg raftpd.Message
+		if err := pd.Unmarshal(&msg, data); err != nil {
+			log.Warnf("%d transport decode message from %d failed: %v", t.id, from, err)
+			return
+		}
+
+		if raft := t.getRaft(); raft != nil {
+			raft.Step(&msg)
+		}
+	}
+}
+
+// streamKind distinguishes connections of a peer.
+type streamKind byte
+
+const (
+	streamPipeline streamKind = iota
+	streamSnapshot
+)
+
+var streamKindString = []string{
+	"Pipeline",
+	"Snapshot",
+}
+
+func (kind streamKind) String() string {
+	return streamKindString[kind]
+}
+
+// writeHello write id of sender and kind of stream, it is the first
+// frame of each connection.
+func writeHello(w *bufio.Writer, from uint64, kind streamKind) error {
+	var buf [binary.MaxVarintLen64 + 1]byte
+	buf[0] = byte(kind)
+	n := binary.PutUvarint(buf[1:], from)
+	if _, err := w.Write(buf[:n+1]); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readHello(r *bufio.Reader) (uint64, streamKind, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if streamKind(kind) != streamPipeline && streamKind(kind) != streamSnapshot {
+		return 0, 0, fmt.Errorf("unknown stream kind: %d", kind)
+	}
+	from, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, streamKind(kind), nil
+}
+
+// writeFrame write length of data and data.
+func writeFrame(w *bufio.Writer, data []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(data)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame read a frame written by writeFrame.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame size %d exceeds limit", size)
+	}
+	// Buffer grows as data arrives, so that a corrupted or forged
+	// size doesn't allocate more memory than data actually received.
+	buf := &bytes.Buffer{}
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,282 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thinkermao/bior/raft"
+	"github.com/thinkermao/bior/raft/core"
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+)
+
+type testApp struct {
+	mutex   sync.Mutex
+	entries [][]byte
+}
+
+func (app *testApp) ApplyEntry(entry *raftpd.Entry) {
+	if len(entry.Data) == 0 {
+		return
+	}
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.entries = append(app.entries, entry.Data)
+}
+
+func (app *testApp) ReadStateNotice(idx uint64, bytes []byte) {}
+
+func (app *testApp) ApplySnapshot(snapshot *raftpd.Snapshot) {}
+
+func (app *testApp) ReadSnapshot() *raftpd.Snapshot {
+	return &raftpd.Snapshot{}
+}
+
+func (app *testApp) applied(data []byte) bool {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	for _, entry := range app.entries {
+		if bytes.Equal(entry, data) {
+			return true
+		}
+	}
+	return false
+}
+
+type testRaft struct {
+	mutex    sync.Mutex
+	msgs     []raftpd.Message
+	failures []uint64
+	reports  []core.SnapshotStatus
+}
+
+func (r *testRaft) Step(msg *raftpd.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.msgs = append(r.msgs, *msg)
+}
+
+func (r *testRaft) Unreachable(peer uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures = append(r.failures, peer)
+}
+
+func (r *testRaft) ReportSnapshot(peer uint64, status core.SnapshotStatus) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = append(r.reports, status)
+}
+
+func (r *testRaft) received() []raftpd.Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]raftpd.Message{}, r.msgs...)
+}
+
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not satisfied after %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func makeTransports(t *testing.T, ids ...uint64) []*Transport {
+	transports := make([]*Transport, 0, len(ids))
+	for _, id := range ids {
+		trans, err := MakeTransport(id, "127.0.0.1:0", nil, pd.BinaryCodec)
+		if err != nil {
+			t.Fatalf("make transport %d: %v", id, err)
+		}
+		transports = append(transports, trans)
+	}
+	for i, trans := range transports {
+		for j, other := range transports {
+			if i != j {
+				trans.AddPeer(ids[j], other.Addr().String())
+			}
+		}
+	}
+	return transports
+}
+
+func TestTransport_Pipeline(t *testing.T) {
+	transports := makeTransports(t, 1, 2)
+	defer transports[0].Close()
+	defer transports[1].Close()
+
+	r := &testRaft{}
+	transports[1].Bind(r)
+
+	for i := uint64(1); i <= 100; i++ {
+		msgType := raftpd.MsgAppendRequest
+		if i%10 == 0 {
+			msgType = raftpd.MsgSnapshotRequest
+		}
+		msg := raftpd.Message{MsgType: msgType, From: 1, To: 2, Index: i}
+		if err := transports[0].Send(2, &msg); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	waitUntil(t, 5*time.Second, func() bool { return len(r.received()) == 100 })
+
+	// messages of same stream keep order.
+	var last [2]uint64
+	for _, msg := range r.received() {
+		kind := 0
+		if msg.MsgType == raftpd.MsgSnapshotRequest {
+			kind = 1
+		}
+		if msg.Index <= last[kind] {
+			t.Fatalf("message %d received after %d", msg.Index, last[kind])
+		}
+		last[kind] = msg.Index
+	}
+}
+
+func TestTransport_Unreachable(t *testing.T) {
+	transports := makeTransports(t, 1, 2)
+	defer transports[0].Close()
+
+	r := &testRaft{}
+	transports[0].Bind(r)
+	transports[1].Close()
+
+	msg := raftpd.Message{MsgType: raftpd.MsgAppendRequest, From: 1, To: 2}
+	snap := raftpd.Message{MsgType: raftpd.MsgSnapshotRequest, From: 1, To: 2}
+	waitUntil(t, 5*time.Second, func() bool {
+		transports[0].Send(2, &msg)
+		transports[0].Send(2, &snap)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return len(r.failures) > 0 && len(r.reports) > 0
+	})
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failures[0] != 2 {
+		t.Fatalf("unreachable want: 2, get: %d", r.failures[0])
+	}
+	if r.reports[0] != core.SnapshotFailure {
+		t.Fatalf("snapshot status want: %v, get: %v", core.SnapshotFailure, r.reports[0])
+	}
+
+	if err := transports[0].Send(3, &msg); err != ErrUnknownPeer {
+		t.Fatalf("send to unknown peer want: %v, get: %v", ErrUnknownPeer, err)
+	}
+}
+
+func TestTransport_Reconnect(t *testing.T) {
+	transports := makeTransports(t, 1, 2)
+	defer transports[0].Close()
+
+	addr := transports[1].Addr().String()
+	transports[1].Close()
+
+	msg := raftpd.Message{MsgType: raftpd.MsgHeartbeatRequest, From: 1, To: 2}
+	transports[0].Send(2, &msg)
+
+	// restart peer at same address.
+	restarted, err := MakeTransport(2, addr, nil, pd.BinaryCodec)
+	if err != nil {
+		t.Skipf("address %s reused failed: %v", addr, err)
+	}
+	defer restarted.Close()
+
+	r := &testRaft{}
+	restarted.Bind(r)
+	waitUntil(t, 5*time.Second, func() bool {
+		transports[0].Send(2, &msg)
+		return len(r.received()) > 0
+	})
+}
+
+func TestTransport_Raft(t *testing.T) {
+	ids := []uint64{1, 2, 3}
+	transports := makeTransports(t, ids...)
+	apps := make([]*testApp, len(ids))
+	rafts := make([]*raft.Raft, len(ids))
+	for i, id := range ids {
+		apps[i] = &testApp{}
+		rf, err := raft.MakeRaft(id, ids, 300, 50, 10, 1024*1024,
+			raft.MakeMemoryStorage(raft.Metadata{}), apps[i], transports[i])
+		if err != nil {
+			t.Fatalf("make raft %d: %v", id, err)
+		}
+		transports[i].Bind(rf)
+		rafts[i] = rf
+	}
+	defer func() {
+		for i := range ids {
+			rafts[i].Kill()
+			transports[i].Close()
+		}
+	}()
+
+	data := []byte("hello")
+	waitUntil(t, 10*time.Second, func() bool {
+		for _, rf := range rafts {
+			if _, isLeader := rf.GetState(); isLeader {
+				_, _, ok := rf.Write(data)
+				return ok
+			}
+		}
+		return false
+	})
+
+	waitUntil(t, 10*time.Second, func() bool {
+		for _, app := range apps {
+			if !app.applied(data) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// read index is forwarded to leader by followers.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, rf := range rafts {
+		if err := rf.ReadIndex(ctx); err != nil {
+			t.Fatalf("%d read index: %v", ids[i], err)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	frame := func(size uint64, data []byte) *bufio.Reader {
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], size)
+		return bufio.NewReader(bytes.NewReader(append(buf[:n], data...)))
+	}
+
+	tests := []struct {
+		r    *bufio.Reader
+		data []byte
+		ok   bool
+	}{
+		{frame(0, nil), []byte{}, true},
+		{frame(3, []byte("abc")), []byte("abc"), true},
+		/* size claims more than data sent */
+		{frame(maxFrameSize, []byte("abc")), nil, false},
+		{frame(maxFrameSize+1, []byte("abc")), nil, false},
+	}
+	for i, test := range tests {
+		data, err := readFrame(test.r)
+		if (err == nil) != test.ok {
+			t.Fatalf("#%d ok want: %v, get: %v", i, test.ok, err)
+		}
+		if test.ok && !bytes.Equal(data, test.data) {
+			t.Fatalf("#%d data want: %v, get: %v", i, test.data, data)
+		}
+	}
+}
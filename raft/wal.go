@@ -2,22 +2,29 @@ package raft
 
 import (
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/thinkermao/bior/raft/proto"
 	"github.com/thinkermao/bior/utils/pd"
 	"github.com/thinkermao/wal-go"
 )
 
-type Metadata struct {
-	Index uint64
-	Term  uint64
-}
+// legacyMigrating is the temporary directory legacy wal is moved into.
+const legacyMigrating = "0000000000000000.migrating"
 
 type recordType int
 
 const (
 	recordEntry recordType = iota
 	recordState
+	recordConfState
 )
 
 type record struct {
@@ -27,35 +34,116 @@ type record struct {
 
 func (r *record) Reset() { *r = record{} }
 
+func (r *record) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(uint64(r.Type))
+	enc.PutBytes(r.Data)
+}
+
+func (r *record) DecodeFrom(dec *pd.Decoder) {
+	r.Type = recordType(dec.Uvarint())
+	r.Data = dec.Bytes()
+}
+
+// confRecord is the configuration applied at index.
+type confRecord struct {
+	Index uint64
+	State raftpd.ConfState
+}
+
+func (r *confRecord) Reset() { *r = confRecord{} }
+
+func (r *confRecord) EncodeTo(enc *pd.Encoder) {
+	enc.PutUvarint(r.Index)
+	r.State.EncodeTo(enc)
+}
+
+func (r *confRecord) DecodeFrom(dec *pd.Decoder) {
+	r.Index = dec.Uvarint()
+	r.State.DecodeFrom(dec)
+}
+
 func init() {
 	gob.Register(record{})
+	gob.Register(confRecord{})
 }
 
+// logStorage implements the Storage interface by wal. Records are
+// written into segments, each segment is a wal under walDir named by
+// the index of last entry before it. Compact switches to a new segment,
+// and releases segments whose entries are wholly covered by snapshot.
+//
+// walDir
+// +-- 0000000000000000 ( entries (0, 100] )
+// +-- 0000000000000064 ( entries (100, 230] )
+// +-- 00000000000000e6 ( entries (230, ...), current segment )
 type logStorage struct {
-	wal *wal.Wal
+	mutex sync.Mutex
+
+	codec    pd.Codec // codec used to encode records.
+	walDir   string
+	segments []uint64 // index of segments, in ascending order.
+	wal      *wal.Wal // wal of the last segment.
+
+	// last index of entries written to wal, state record
+	// is written at this position.
+	lastIndex uint64
+
+	// latest hard state, it will be rewritten to new segment.
+	state    raftpd.HardState
+	hasState bool
+
+	// latest configuration, it will be rewritten to new segment.
+	conf confRecord
+
+	// entries after dummy entry of last compaction, it
+	// keeps the same content as wal, so Load could be called
+	// any times.
+	entries []raftpd.Entry
 }
 
-func CreateLogStorage(walDir string, meta Metadata) (*logStorage, error) {
-	w, err := wal.Create(walDir, meta.Index)
-	if err != nil {
+// CreateLogStorage create a new wal at walDir, and returns Storage
+// whose dummy entry is from meta. Records are encoded by codec.
+func CreateLogStorage(walDir string, meta Metadata, codec pd.Codec) (Storage, error) {
+	ls := &logStorage{
+		codec:     codec,
+		walDir:    walDir,
+		lastIndex: meta.Index,
+		entries:   []raftpd.Entry{dummyEntry(meta)},
+	}
+	if err := ls.createSegment(meta.Index); err != nil {
 		return nil, err
 	}
-
-	return &logStorage{wal: w}, nil
+	return ls, nil
 }
 
 // RestoreLogStorage restore records for raft from wal,
-// entries has a dummy entry from meta.
-func RestoreLogStorage(walDir string, meta Metadata) (
-	ls *logStorage, entries []raftpd.Entry, HS raftpd.HardState, err error) {
-
-	entries = []raftpd.Entry{}
-	// dummy entry
-	entries = append(entries, raftpd.Entry{
-		Type:  raftpd.EntryNormal,
-		Index: meta.Index,
-		Term:  meta.Term,
-	})
+// records could be read by Storage.Load. Segments wholly
+// covered by meta are skipped and released. Records of any
+// codec could be read, and new records are encoded by codec.
+// Wal written directly into walDir by versions before segments
+// is migrated into the first segment.
+func RestoreLogStorage(walDir string, meta Metadata, codec pd.Codec) (Storage, error) {
+	ls := &logStorage{
+		codec:     codec,
+		walDir:    walDir,
+		lastIndex: meta.Index,
+		entries:   []raftpd.Entry{dummyEntry(meta)},
+	}
+
+	if err := migrateLegacyWal(walDir); err != nil {
+		return nil, err
+	}
+	segments, err := readSegments(walDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no wal segment exists in %s", walDir)
+	}
+	ls.segments = segments
+	if err := ls.releaseSegments(meta.Index); err != nil {
+		return nil, err
+	}
 
 	recordReader := func(index uint64, data []byte) error {
 		var record record
@@ -63,45 +151,59 @@ func RestoreLogStorage(walDir string, meta Metadata) (
 
 		var entry raftpd.Entry
 		var state raftpd.HardState
+		var conf confRecord
 		switch record.Type {
 		case recordEntry:
 			if err := pd.Unmarshal(&entry, record.Data); err != nil {
 				return err
 			}
-			/* truncate and append */
-			idx := 0
-			for i := len(entries) - 1; i >= 0; i-- {
-				if entry.Index > entries[i].Index {
-					idx = i + 1
-					break
-				}
+			if entry.Index <= meta.Index {
+				/* covered by snapshot */
+				return nil
 			}
-			entries = append(entries[:idx], entry)
+			/* truncate and append */
+			ls.entries = appendEntry(ls.entries, &entry)
+			ls.lastIndex = entry.Index
 			return nil
 		case recordState:
 			if err := pd.Unmarshal(&state, record.Data); err != nil {
 				return err
 			}
 			/* use latest hard state */
-			HS = state
+			ls.state = state
+			ls.hasState = true
+			return nil
+		case recordConfState:
+			if err := pd.Unmarshal(&conf, record.Data); err != nil {
+				return err
+			}
+			/* use latest configuration */
+			ls.conf = conf
 			return nil
 		}
 
 		panic("wrong type of record")
 	}
 
-	var w *wal.Wal
-	w, err = wal.Open(walDir, meta.Index, recordReader)
-	if err != nil {
-		return
+	for i := 0; i < len(ls.segments); i++ {
+		w, err := wal.Open(ls.segmentDir(ls.segments[i]), meta.Index, recordReader)
+		if err != nil {
+			return nil, err
+		}
+		if i+1 < len(ls.segments) {
+			/* only last segment is writable */
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ls.wal = w
 	}
-
-	ls = &logStorage{wal: w}
-	return
+	return ls, nil
 }
 
 func (ls *logStorage) saveState(at uint64, state *raftpd.HardState) (<-chan error, error) {
-	bytes, err := pd.Marshal(state)
+	bytes, err := ls.codec.Marshal(state)
 	if err != nil {
 		return nil, err
 	}
@@ -110,11 +212,32 @@ func (ls *logStorage) saveState(at uint64, state *raftpd.HardState) (<-chan erro
 		Type: recordState,
 		Data: bytes,
 	}
-	return ls.wal.Write(at, pd.MustMarshal(&rec)), nil
+	data, err := ls.codec.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+	return ls.wal.Write(at, data), nil
+}
+
+func (ls *logStorage) saveConf(at uint64, conf *confRecord) (<-chan error, error) {
+	bytes, err := ls.codec.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := record{
+		Type: recordConfState,
+		Data: bytes,
+	}
+	data, err := ls.codec.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+	return ls.wal.Write(at, data), nil
 }
 
 func (ls *logStorage) saveEntry(entry *raftpd.Entry) (<-chan error, error) {
-	bytes, err := pd.Marshal(entry)
+	bytes, err := ls.codec.Marshal(entry)
 	if err != nil {
 		return nil, err
 	}
@@ -123,11 +246,18 @@ func (ls *logStorage) saveEntry(entry *raftpd.Entry) (<-chan error, error) {
 		Type: recordEntry,
 		Data: bytes,
 	}
-	return ls.wal.Write(entry.Index, pd.MustMarshal(&rec)), nil
+	data, err := ls.codec.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+	return ls.wal.Write(entry.Index, data), nil
 }
 
-func (ls *logStorage) save(lastIndex uint64,
-	state *raftpd.HardState, entries []raftpd.Entry) error {
+// SaveEntries implements Storage.SaveEntries.
+func (ls *logStorage) SaveEntries(entries []raftpd.Entry) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
 	var errorChs []<-chan error
 
 	for i := 0; i < len(entries); i++ {
@@ -137,28 +267,243 @@ func (ls *logStorage) save(lastIndex uint64,
 			return err
 		}
 		errorChs = append(errorChs, ch)
+		ls.lastIndex = entry.Index
+		if entry.Index > ls.entries[0].Index {
+			ls.entries = appendEntry(ls.entries, entry)
+		}
 	}
 
-	if state != nil {
-		ch, err := ls.saveState(lastIndex, state)
+	return waitAll(errorChs)
+}
+
+// SaveHardState implements Storage.SaveHardState.
+func (ls *logStorage) SaveHardState(state *raftpd.HardState) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ch, err := ls.saveState(ls.lastIndex, state)
+	if err != nil {
+		return err
+	}
+	ls.state = *state
+	ls.hasState = true
+	return <-ch
+}
+
+// SaveConfState implements Storage.SaveConfState.
+func (ls *logStorage) SaveConfState(index uint64, state *raftpd.ConfState) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	conf := confRecord{Index: index, State: *state}
+	ch, err := ls.saveConf(ls.lastIndex, &conf)
+	if err != nil {
+		return err
+	}
+	ls.conf = conf
+	return <-ch
+}
+
+// Sync implements Storage.Sync.
+func (ls *logStorage) Sync() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return <-ls.wal.Sync()
+}
+
+// Load implements Storage.Load.
+func (ls *logStorage) Load() ([]raftpd.Entry, raftpd.HardState, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	entries := make([]raftpd.Entry, len(ls.entries))
+	copy(entries, ls.entries)
+	return entries, ls.state, nil
+}
+
+// LoadConfState implements Storage.LoadConfState.
+func (ls *logStorage) LoadConfState() (uint64, raftpd.ConfState, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.conf.Index, ls.conf.State, nil
+}
+
+// Compact implements Storage.Compact, it switches to a new segment,
+// so that records before meta.Index could be released by next compaction,
+// and releases segments wholly covered by meta.
+func (ls *logStorage) Compact(meta Metadata) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.entries = compactEntries(ls.entries, meta)
+	last := ls.segments[len(ls.segments)-1]
+	if last < ls.lastIndex && last < meta.Index {
+		if err := ls.rotate(); err != nil {
+			return err
+		}
+	}
+	return ls.releaseSegments(meta.Index)
+}
+
+// Close implements Storage.Close.
+func (ls *logStorage) Close() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.wal.Close()
+}
+
+func (ls *logStorage) segmentDir(index uint64) string {
+	return filepath.Join(ls.walDir, fmt.Sprintf("%016x", index))
+}
+
+func (ls *logStorage) createSegment(index uint64) error {
+	dir := ls.segmentDir(index)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	w, err := wal.Create(dir, index)
+	if err != nil {
+		return err
+	}
+	ls.wal = w
+	ls.segments = append(ls.segments, index)
+	return nil
+}
+
+// rotate close current segment, and create a new one after lastIndex,
+// latest hard state and configuration are rewritten into the new
+// segment so that they survive after old segments released.
+func (ls *logStorage) rotate() error {
+	if err := <-ls.wal.Sync(); err != nil {
+		return err
+	}
+	if err := ls.wal.Close(); err != nil {
+		return err
+	}
+	if err := ls.createSegment(ls.lastIndex); err != nil {
+		return err
+	}
+
+	log.Debugf("wal %s switch to new segment at %d", ls.walDir, ls.lastIndex)
+
+	var errorChs []<-chan error
+	if ls.hasState {
+		ch, err := ls.saveState(ls.lastIndex, &ls.state)
 		if err != nil {
 			return err
 		}
 		errorChs = append(errorChs, ch)
 	}
+	if ls.conf.Index != 0 {
+		ch, err := ls.saveConf(ls.lastIndex, &ls.conf)
+		if err != nil {
+			return err
+		}
+		errorChs = append(errorChs, ch)
+	}
+	if len(errorChs) == 0 {
+		return nil
+	}
+	if err := waitAll(errorChs); err != nil {
+		return err
+	}
+	return <-ls.wal.Sync()
+}
 
-	for _, ch := range errorChs {
-		if err := <-ch; err != nil {
+// releaseSegments remove segments whose entries are wholly
+// covered by index, the last segment is always kept.
+func (ls *logStorage) releaseSegments(index uint64) error {
+	for len(ls.segments) > 1 && ls.segments[1] <= index {
+		if err := os.RemoveAll(ls.segmentDir(ls.segments[0])); err != nil {
 			return err
 		}
+		log.Debugf("wal %s release segment %d, covered by %d",
+			ls.walDir, ls.segments[0], index)
+		ls.segments = ls.segments[1:]
 	}
 	return nil
 }
 
-func (ls *logStorage) sync() error {
-	return <-ls.wal.Sync()
+// migrateLegacyWal move wal written directly into walDir, by versions
+// before segments, into the first segment. Files are moved into a
+// temporary directory which is renamed to the segment after all moved,
+// so migration interrupted by crash is resumed on next restore.
+func migrateLegacyWal(walDir string) error {
+	segments, err := readSegments(walDir)
+	if err != nil || len(segments) > 0 {
+		return err
+	}
+	infos, err := ioutil.ReadDir(walDir)
+	if err != nil || len(infos) == 0 {
+		return err
+	}
+
+	tmp := filepath.Join(walDir, legacyMigrating)
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == legacyMigrating {
+			continue
+		}
+		if err := os.Rename(filepath.Join(walDir, info.Name()),
+			filepath.Join(tmp, info.Name())); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(walDir, fmt.Sprintf("%016x", 0))); err != nil {
+		return err
+	}
+
+	log.Infof("wal %s migrate legacy wal into segment %016x", walDir, 0)
+	return syncDir(walDir)
 }
 
-func (ls *logStorage) close() error {
-	return ls.wal.Close()
+// readSegments return index of segments under walDir in ascending order.
+func readSegments(walDir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		index, err := strconv.ParseUint(info.Name(), 16, 64)
+		if err != nil {
+			/* not a segment */
+			continue
+		}
+		segments = append(segments, index)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func waitAll(errorChs []<-chan error) error {
+	for _, ch := range errorChs {
+		if err := <-ch; err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,218 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/thinkermao/bior/raft/proto"
+	"github.com/thinkermao/bior/utils/pd"
+	"github.com/thinkermao/wal-go"
+)
+
+func makeRangeEntries(from, to uint64) []raftpd.Entry {
+	var idxs []uint64
+	for i := from; i <= to; i++ {
+		idxs = append(idxs, i)
+	}
+	return makeEntries(idxs...)
+}
+
+func makeWalDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bior-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func checkSegments(t *testing.T, i int, walDir string, want []uint64) {
+	segments, err := readSegments(walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Fatalf("#%d: segments want: %v, get: %v", i, want, segments)
+	}
+}
+
+// writeSegments write entries (0, 20] with compaction at 5 and 15,
+// so that segment 0 is released, and segment 10 straddles 15.
+func writeSegments(t *testing.T, walDir string) {
+	storage, err := CreateLogStorage(walDir, Metadata{}, pd.BinaryCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	tests := []struct {
+		entries  []raftpd.Entry
+		compact  uint64
+		segments []uint64
+	}{
+		/* segment 0 straddles 5, kept */
+		{makeRangeEntries(1, 10), 5, []uint64{0, 10}},
+		/* segment 0 wholly below 15, released */
+		{makeRangeEntries(11, 20), 15, []uint64{10, 20}},
+	}
+	for i, test := range tests {
+		last := test.entries[len(test.entries)-1].Index
+		if err := storage.SaveEntries(test.entries); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.SaveHardState(&raftpd.HardState{Term: last, Commit: last}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			state := raftpd.ConfState{Nodes: []uint64{1, 2}}
+			if err := storage.SaveConfState(3, &state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := storage.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Compact(Metadata{Index: test.compact, Term: test.compact}); err != nil {
+			t.Fatal(err)
+		}
+		checkSegments(t, i, walDir, test.segments)
+	}
+}
+
+func TestLogStorage_ReleaseSegments(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	writeSegments(t, walDir)
+}
+
+func TestLogStorage_RestoreAfterRelease(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	writeSegments(t, walDir)
+
+	tests := []struct {
+		meta     Metadata
+		entries  []raftpd.Entry
+		segments []uint64
+	}{
+		{Metadata{15, 15}, makeRangeEntries(15, 20), []uint64{10, 20}},
+		/* segment 10 is wholly covered on restart */
+		{Metadata{20, 20}, makeRangeEntries(20, 20), []uint64{20}},
+	}
+	for i, test := range tests {
+		storage, err := RestoreLogStorage(walDir, test.meta, pd.BinaryCodec)
+		if err != nil {
+			t.Fatalf("#%d: restore: %v", i, err)
+		}
+		entries, state, err := storage.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareEntries(t, i, entries, test.entries)
+		if state.Term != 20 || state.Commit != 20 {
+			t.Fatalf("#%d: hard state want term and commit 20, get: %+v", i, state)
+		}
+		index, conf, err := storage.LoadConfState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != 3 || !reflect.DeepEqual(conf.Nodes, []uint64{1, 2}) {
+			t.Fatalf("#%d: conf state want [1 2] at 3, get: %v at %d", i, conf.Nodes, index)
+		}
+		checkSegments(t, i, walDir, test.segments)
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLogStorage_Load(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	storage, err := CreateLogStorage(walDir, Metadata{}, pd.BinaryCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	tests := []struct {
+		prepare func() error
+		entries []raftpd.Entry
+	}{
+		{func() error { return nil }, makeRangeEntries(0, 0)},
+		{func() error { return storage.SaveEntries(makeRangeEntries(1, 5)) }, makeRangeEntries(0, 5)},
+		/* truncate and append */
+		{func() error { return storage.SaveEntries(makeRangeEntries(4, 6)) }, makeRangeEntries(0, 6)},
+		{func() error { return storage.Compact(Metadata{3, 3}) }, makeRangeEntries(3, 6)},
+	}
+	for i, test := range tests {
+		if err := test.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		/* load could be called any times */
+		for j := 0; j < 2; j++ {
+			entries, _, err := storage.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareEntries(t, i, entries, test.entries)
+		}
+	}
+}
+
+// writeLegacyWal write entries and hard state into walDir directly,
+// like versions before segments.
+func writeLegacyWal(t *testing.T, walDir string, entries []raftpd.Entry, state *raftpd.HardState) {
+	w, err := wal.Create(walDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &logStorage{
+		codec:   pd.GobCodec,
+		walDir:  walDir,
+		wal:     w,
+		entries: []raftpd.Entry{dummyEntry(Metadata{})},
+	}
+	if err := storage.SaveEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveHardState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogStorage_RestoreLegacy(t *testing.T) {
+	walDir := makeWalDir(t)
+	defer os.RemoveAll(walDir)
+
+	writeLegacyWal(t, walDir, makeRangeEntries(1, 3), &raftpd.HardState{Term: 3, Vote: 1, Commit: 2})
+
+	for i := 0; i < 2; i++ {
+		storage, err := RestoreLogStorage(walDir, Metadata{}, pd.BinaryCodec)
+		if err != nil {
+			t.Fatalf("#%d: restore: %v", i, err)
+		}
+		entries, state, err := storage.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareEntries(t, i, entries, makeRangeEntries(0, 3))
+		if state != (raftpd.HardState{Term: 3, Vote: 1, Commit: 2}) {
+			t.Fatalf("#%d: hard state want: term 3, vote 1, commit 2, get: %+v", i, state)
+		}
+		checkSegments(t, i, walDir, []uint64{0})
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
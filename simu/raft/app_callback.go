@@ -37,12 +37,9 @@ func (app *application) ApplyEntry(entry *raftpd.Entry) {
 	}
 }
 
-func (app *application) ReadStateNotice(idx uint64, bytes []byte) {
-	app.logMutex.Lock()
-	app.logMutex.Unlock()
-
-	// TODO:
-}
+// ReadStateNotice is only called for contexts given by raft.Read,
+// linearizable reads wait by raft.ReadIndex instead.
+func (app *application) ReadStateNotice(idx uint64, bytes []byte) {}
 
 func (app *application) ApplySnapshot(snapshot *raftpd.Snapshot) {
 	persist := app.getPersist()
@@ -89,7 +89,10 @@ func (app *application) handleMessage(from int, data []byte) {
 
 func (app *application) Send(to uint64, msg pd.Messager) error {
 	log.Debugf("app id: %d send: %v", app.id, msg)
-	data := pd.MustMarshal(msg)
+	data, err := pd.BinaryCodec.Marshal(msg)
+	if err != nil {
+		return err
+	}
 	return app.handler.Call(int(to), data)
 }
 
@@ -97,22 +100,22 @@ func (app *application) Send(to uint64, msg pd.Messager) error {
 // allocate new raft object, rebuild from exists
 // wal log.
 func (app *application) Start(nodes []uint64) error {
-	var err error
-	var rf *raft.Raft
-	if app.createPersist() {
-		rf, err = raft.MakeRaft(app.id, nodes,
-			ElectionTimeout, HeartbeatTimeout,
-			tickSize, MaxSizePerMsg, app.walDir, app, app)
-	} else {
-		snapshot := app.ReadSnapshot()
-		meta := raft.Metadata{
-			Index: snapshot.Metadata.Index,
-			Term:  snapshot.Metadata.Term,
-		}
-		rf, err = raft.RebuildRaft(app.id, meta,
-			nodes, ElectionTimeout, HeartbeatTimeout,
-			tickSize, MaxSizePerMsg, app.walDir, app, app)
-		app.restoreFromSnapshot(snapshot)
+	app.createPersist()
+
+	rf, err := raft.StartRaft(&raft.Config{
+		ID:               app.id,
+		Nodes:            nodes,
+		ElectionTimeout:  ElectionTimeout,
+		HeartbeatTimeout: HeartbeatTimeout,
+		TickSize:         tickSize,
+		MaxSizePerMsg:    MaxSizePerMsg,
+		WalDir:           app.walDir,
+		Codec:            pd.BinaryCodec,
+		Application:      app,
+		Transport:        app,
+	})
+	if err != nil {
+		return err
 	}
 
 	app.rfMutex.Lock()
@@ -120,18 +123,18 @@ func (app *application) Start(nodes []uint64) error {
 
 	app.rf = rf
 
-	return err
+	return nil
 }
 
-func (app *application) createPersist() bool {
+// createPersist create persister if it doesn't exist, snapshot
+// saved survives after restart.
+func (app *application) createPersist() {
 	app.rfMutex.Lock()
 	defer app.rfMutex.Unlock()
 
 	if app.persist == nil {
 		app.persist = new(Persister)
-		return true
 	}
-	return false
 }
 
 //
@@ -255,6 +258,9 @@ func (app *application) saveToSnapshot() *raftpd.Snapshot {
 		},
 		Data: data.Bytes(),
 	}
+	if rf := app.getRaft(); rf != nil {
+		snapshot.Metadata.ConfState = rf.ConfState(app.logIndex)
+	}
 	persist.SaveSnapshot(snapshot)
 
 	return snapshot
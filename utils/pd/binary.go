@@ -0,0 +1,133 @@
+package pd
+
+import (
+	"encoding/binary"
+)
+
+// Encoder appends values to buffer in varint based binary format,
+// it is used to implement encoding.BinaryMarshaler.
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes return the encoded bytes.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// PutUvarint append v as uvarint.
+func (e *Encoder) PutUvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	e.buf = append(e.buf, tmp[:n]...)
+}
+
+// PutBool append v as one byte.
+func (e *Encoder) PutBool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// PutBytes append length of v, and v.
+func (e *Encoder) PutBytes(v []byte) {
+	e.PutUvarint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// PutUint64s append length of v, and each of v as uvarint.
+func (e *Encoder) PutUint64s(v []uint64) {
+	e.PutUvarint(uint64(len(v)))
+	for i := 0; i < len(v); i++ {
+		e.PutUvarint(v[i])
+	}
+}
+
+// Decoder reads values encoded by Encoder, the first error
+// is kept, and later reads return zero values.
+type Decoder struct {
+	data    []byte
+	err     error
+	version byte
+}
+
+// MakeDecoder return a Decoder reads from data of current version.
+func MakeDecoder(data []byte) *Decoder {
+	return &Decoder{data: data, version: binaryVersion}
+}
+
+// Version return binary codec version of data, so that
+// data encoded by older layout could be decoded.
+func (d *Decoder) Version() byte {
+	return d.version
+}
+
+// Err return the first error occurred in decoding.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Uvarint read a uvarint.
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = ErrTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// Bool read a bool.
+func (d *Decoder) Bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) < 1 {
+		d.err = ErrTruncated
+		return false
+	}
+	v := d.data[0] != 0
+	d.data = d.data[1:]
+	return v
+}
+
+// Bytes read bytes with length, returns nil if it is empty.
+// The returned bytes is a copy, so data could be reused.
+func (d *Decoder) Bytes() []byte {
+	size := d.Uvarint()
+	if d.err != nil || size == 0 {
+		return nil
+	}
+	if uint64(len(d.data)) < size {
+		d.err = ErrTruncated
+		return nil
+	}
+	v := make([]byte, size)
+	copy(v, d.data)
+	d.data = d.data[size:]
+	return v
+}
+
+// Uint64s read uint64 slice with length, returns nil if it is empty.
+func (d *Decoder) Uint64s() []uint64 {
+	size := d.Uvarint()
+	if d.err != nil || size == 0 {
+		return nil
+	}
+	if uint64(len(d.data)) < size {
+		/* each value takes one byte at least */
+		d.err = ErrTruncated
+		return nil
+	}
+	v := make([]uint64, size)
+	for i := 0; i < len(v); i++ {
+		v[i] = d.Uvarint()
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package pd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// Header of data encoded by BinaryCodec, magic never be the first
+// byte of gob stream, so legacy data could be detected. Version is
+// bumped when layout of existing message changes, data of older
+// versions is still decoded, see Decoder.Version. Version 2 adds
+// ConfState to SnapshotMetadata.
+const (
+	binaryMagic   byte = 0xB1
+	binaryVersion byte = 2
+)
+
+var (
+	// ErrNotBinary means message doesn't implement BinaryMessager.
+	ErrNotBinary = errors.New("message doesn't support binary codec")
+	// ErrTruncated means data is shorter than expected.
+	ErrTruncated = errors.New("binary data truncated")
+)
+
+// Codec encodes Messager to bytes, and decodes them back. Data
+// encoded by any codec could be decoded by others, so codec
+// could be changed without breaking existing data.
+type Codec interface {
+	Marshal(msg Messager) ([]byte, error)
+	Unmarshal(msg Messager, data []byte) error
+}
+
+var (
+	// GobCodec encodes by encoding/gob, it is the legacy format.
+	GobCodec Codec = gobCodec{}
+	// BinaryCodec encodes by compact and versioned binary format,
+	// message must implements BinaryMessager.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// BinaryMessager could be encoded by BinaryCodec. It doesn't use
+// encoding.BinaryMarshaler, because gob prefers it to fields, which
+// breaks decoding of legacy gob data.
+type BinaryMessager interface {
+	Messager
+	EncodeTo(e *Encoder)
+	DecodeFrom(d *Decoder)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(msg Messager) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(msg Messager, data []byte) error {
+	return decode(msg, data)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(msg Messager) ([]byte, error) {
+	bm, ok := msg.(BinaryMessager)
+	if !ok {
+		return nil, ErrNotBinary
+	}
+
+	e := &Encoder{buf: []byte{binaryMagic, binaryVersion}}
+	bm.EncodeTo(e)
+	return e.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(msg Messager, data []byte) error {
+	return decode(msg, data)
+}
+
+// decode detects format of data, and decodes it to msg.
+func decode(msg Messager, data []byte) error {
+	if len(data) == 0 || data[0] != binaryMagic {
+		/* legacy gob data */
+		buf := bytes.NewBuffer(data)
+		decoder := gob.NewDecoder(buf)
+		return decoder.Decode(msg)
+	}
+
+	if len(data) < 2 {
+		return ErrTruncated
+	}
+	if data[1] == 0 || data[1] > binaryVersion {
+		return fmt.Errorf("unknown binary codec version: %d", data[1])
+	}
+	bm, ok := msg.(BinaryMessager)
+	if !ok {
+		return ErrNotBinary
+	}
+	msg.Reset()
+	d := MakeDecoder(data[2:])
+	d.version = data[1]
+	bm.DecodeFrom(d)
+	return d.Err()
+}
@@ -1,9 +1,6 @@
 package pd
 
 import (
-	"bytes"
-	"encoding/gob"
-
 	log "github.com/sirupsen/logrus"
 )
 
@@ -12,14 +9,10 @@ type Messager interface {
 	Reset()
 }
 
-// Marshal encoding msg by gob.
+// Marshal encoding msg by GobCodec, which could be decoded by nodes of
+// any version. Use BinaryCodec explicitly only if all readers support it.
 func Marshal(msg Messager) ([]byte, error) {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(msg); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return GobCodec.Marshal(msg)
 }
 
 // MustMarshal same as Marshal, but panic when
@@ -32,11 +25,10 @@ func MustMarshal(msg Messager) []byte {
 	return d
 }
 
-// Unmarshal data to msg by gob.
+// Unmarshal data to msg, format of data is detected,
+// so data encoded by any Codec could be decoded.
 func Unmarshal(msg Messager, data []byte) error {
-	buf := bytes.NewBuffer(data)
-	decode := gob.NewDecoder(buf)
-	return decode.Decode(msg)
+	return decode(msg, data)
 }
 
 // MustUnmarshal same as Unmarshal, but panic